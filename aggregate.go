@@ -0,0 +1,536 @@
+package mongo
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"strings"
+)
+
+// Pipeline builds an aggregation pipeline one stage at a time.
+//
+// For example:
+//
+//     pipeline := mongo.NewPipeline().
+//             Match(bson.M{"status": "published"}).
+//             Group("$author", bson.M{"posts": bson.M{"$sum": 1}}).
+//             Sort("-posts").
+//             Limit(10)
+//
+// Relevant documentation:
+//
+//     http://docs.mongodb.org/manual/reference/operator/aggregation-pipeline
+//
+type Pipeline struct {
+	stages []bson.D
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// Stage appends a raw stage, for operators without a dedicated method.
+func (p *Pipeline) Stage(operator string, value interface{}) *Pipeline {
+	p.stages = append(p.stages, bson.D{{Name: operator, Value: value}})
+	return p
+}
+
+// Stages returns the stages in the form expected by the server.
+func (p *Pipeline) Stages() []bson.D {
+	return p.stages
+}
+
+// Match filters the documents with a query selector.
+func (p *Pipeline) Match(selector interface{}) *Pipeline {
+	return p.Stage("$match", selector)
+}
+
+// Group groups the documents by the id expression, computing the given
+// accumulators for each group.
+func (p *Pipeline) Group(id interface{}, accumulators bson.M) *Pipeline {
+	group := bson.M{"_id": id}
+	for name, accumulator := range accumulators {
+		group[name] = accumulator
+	}
+	return p.Stage("$group", group)
+}
+
+// Project reshapes the documents.
+func (p *Pipeline) Project(fields interface{}) *Pipeline {
+	return p.Stage("$project", fields)
+}
+
+// Sort orders the documents by the provided field names, which may be
+// prefixed by - (minus) for reverse order as in query.Sort.
+func (p *Pipeline) Sort(fields ...string) *Pipeline {
+	return p.Stage("$sort", sortDocument(fields))
+}
+
+// sortDocument returns the sort document of fields given in the query.Sort
+// syntax.
+func sortDocument(fields []string) bson.D {
+	order := bson.D{}
+	for _, field := range fields {
+		if strings.HasPrefix(field, "-") {
+			order = append(order, bson.DocElem{Name: field[1:], Value: -1})
+		} else {
+			order = append(order, bson.DocElem{Name: strings.TrimPrefix(field, "+"), Value: 1})
+		}
+	}
+	return order
+}
+
+// Skip skips over the n initial documents.
+func (p *Pipeline) Skip(n int) *Pipeline {
+	return p.Stage("$skip", n)
+}
+
+// Limit passes on at most n documents.
+func (p *Pipeline) Limit(n int) *Pipeline {
+	return p.Stage("$limit", n)
+}
+
+// Lookup joins the documents of the from collection whose foreignField
+// equals localField, storing them as an array in the as field. When from is
+// the collection of a repository, the filter of its HookRewriteSearch is
+// matched on the joined documents, which needs MongoDB 5.0 or later.
+func (p *Pipeline) Lookup(from, localField, foreignField, as string) *Pipeline {
+	return p.Stage("$lookup", bson.M{
+		"from":         from,
+		"localField":   localField,
+		"foreignField": foreignField,
+		"as":           as,
+	})
+}
+
+// Unwind outputs one document per element of the array at path. When
+// preserveEmpty is true documents with a missing, null or empty array are
+// kept.
+func (p *Pipeline) Unwind(path string, preserveEmpty bool) *Pipeline {
+	if !strings.HasPrefix(path, "$") {
+		path = "$" + path
+	}
+	return p.Stage("$unwind", bson.M{
+		"path": path,
+		"preserveNullAndEmptyArrays": preserveEmpty,
+	})
+}
+
+// Facet runs several sub-pipelines over the same input documents, storing
+// the output of each one under its name.
+func (p *Pipeline) Facet(facets map[string]*Pipeline) *Pipeline {
+	facet := bson.M{}
+	for name, pipeline := range facets {
+		facet[name] = pipeline.Stages()
+	}
+	return p.Stage("$facet", facet)
+}
+
+type aggregation struct {
+	operator     *repositoryOperator
+	pipeline     interface{}
+	resolved     interface{}
+	allowDiskUse bool
+	batch        int
+
+	collectErrors bool
+}
+
+// Aggregate prepares the aggregation of the repository collection through
+// pipeline, which is either a *Pipeline or a slice of stages as accepted by
+// the server.
+func (self *repositoryOperator) Aggregate(pipeline interface{}) *aggregation {
+	if p, ok := pipeline.(*Pipeline); ok {
+		pipeline = p.Stages()
+	}
+	return &aggregation{operator: self, pipeline: pipeline}
+}
+
+// stages returns the stages of the pipeline as a slice.
+func (self *aggregation) stages() []interface{} {
+	return pipelineStages(self.pipeline)
+}
+
+// pipelineStages returns the stages of pipeline, a slice of stages or a
+// single one, as a slice.
+func pipelineStages(pipeline interface{}) []interface{} {
+	if pipeline == nil {
+		return nil
+	}
+	pipelinev := reflect.ValueOf(pipeline)
+	if pipelinev.Kind() != reflect.Slice {
+		return []interface{}{pipeline}
+	}
+
+	stages := make([]interface{}, pipelinev.Len())
+	for i := range stages {
+		stages[i] = pipelinev.Index(i).Interface()
+	}
+	return stages
+}
+
+// AllowDiskUse lets the stages write temporary files when they exceed the
+// server memory limit.
+func (self *aggregation) AllowDiskUse() *aggregation {
+	self.allowDiskUse = true
+	return self
+}
+
+// CollectHookErrors makes All leave out the documents whose load hooks fail
+// instead of aborting, as query.CollectHookErrors.
+func (self *aggregation) CollectHookErrors() *aggregation {
+	self.collectErrors = true
+	return self
+}
+
+// Batch sets the number of documents returned by the server per round trip.
+func (self *aggregation) Batch(n int) *aggregation {
+	self.batch = n
+	return self
+}
+
+type aggregationCursor struct {
+	Cursor struct {
+		Id         int64      `bson:"id"`
+		FirstBatch []bson.Raw `bson:"firstBatch"`
+		NextBatch  []bson.Raw `bson:"nextBatch"`
+	} `bson:"cursor"`
+}
+
+type aggregationIter struct {
+	aggregation *aggregation
+	id          int64
+	docs        []bson.Raw
+	err         error
+}
+
+// iter runs the pipeline and returns an iterator over the results.
+func (self *aggregation) iter() *aggregationIter {
+	options := bson.M{}
+	if self.batch > 0 {
+		options["batchSize"] = self.batch
+	}
+
+	cmd := bson.D{
+		{Name: "aggregate", Value: self.operator.collection.Name},
+		{Name: "pipeline", Value: self.resolved},
+		{Name: "cursor", Value: options},
+	}
+	if self.allowDiskUse {
+		cmd = append(cmd, bson.DocElem{Name: "allowDiskUse", Value: true})
+	}
+	if maxTime := self.operator.maxTimeMS(); maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: maxTime})
+	}
+
+	iter := &aggregationIter{aggregation: self}
+	if iter.err = self.operator.ctx.Err(); iter.err != nil {
+		return iter
+	}
+
+	var result aggregationCursor
+	iter.err = self.operator.wrapError(self.operator.collection.Database.Run(cmd, &result))
+	iter.id = result.Cursor.Id
+	iter.docs = result.Cursor.FirstBatch
+	return iter
+}
+
+// Next unmarshals the next result into raw, fetching more results from the
+// server as needed. It returns false at the end of the results or on error.
+func (self *aggregationIter) Next(raw *bson.Raw) bool {
+	for len(self.docs) == 0 {
+		if self.err != nil || self.id == 0 {
+			return false
+		}
+
+		operator := self.aggregation.operator
+		if self.err = operator.ctx.Err(); self.err != nil {
+			return false
+		}
+
+		cmd := bson.D{
+			{Name: "getMore", Value: self.id},
+			{Name: "collection", Value: operator.collection.Name},
+		}
+		if self.aggregation.batch > 0 {
+			cmd = append(cmd, bson.DocElem{Name: "batchSize", Value: self.aggregation.batch})
+		}
+
+		var result aggregationCursor
+		self.err = operator.wrapError(operator.collection.Database.Run(cmd, &result))
+		self.id = result.Cursor.Id
+		self.docs = result.Cursor.NextBatch
+	}
+
+	*raw = self.docs[0]
+	self.docs = self.docs[1:]
+	return true
+}
+
+// Close releases the server cursor, if still open, and returns the error
+// that interrupted the iteration, if any.
+func (self *aggregationIter) Close() error {
+	if self.id != 0 {
+		collection := self.aggregation.operator.collection
+		err := collection.Database.Run(bson.D{
+			{Name: "killCursors", Value: collection.Name},
+			{Name: "cursors", Value: []int64{self.id}},
+		}, nil)
+		if self.err == nil {
+			self.err = err
+		}
+		self.id = 0
+	}
+	return self.err
+}
+
+// All unmarshals every result into the slice pointed by result. The load
+// hooks run on the elements implementing them, so results may be decoded
+// into the repository type or into any struct shaped after the pipeline.
+func (self *aggregation) All(result interface{}) error {
+	return self.run(result, func() error {
+		return self.all(result)
+	})
+}
+
+// run executes operation as a search between the repository middlewares.
+func (self *aggregation) run(result interface{}, operation func() error) error {
+	e := &HookEvent{Operation: OperationSearch, Selector: self.pipeline, Document: result}
+	return self.operator.run(e, func() error {
+		// The search rewrite hook sees a nil selector; the filter it
+		// returns is matched ahead of the pipeline.
+		selector, err := self.operator.rewrite(OperationSearch, nil)
+		if err != nil {
+			return err
+		}
+
+		stages, joins, err := self.operator.resolveStages(self.stages())
+		if err != nil {
+			return err
+		}
+		if selector != nil {
+			stages = matchStages(stages, selector)
+		}
+		self.resolved = stages
+
+		// The search hooks of the joined repositories run within those of
+		// the aggregated one, each seeing its own filter.
+		for i := len(joins) - 1; i >= 0; i-- {
+			join, next := joins[i], operation
+			operation = func() error {
+				return join.operator.search(join.selector, next)
+			}
+		}
+		return self.operator.search(selector, operation)
+	})
+}
+
+// aggregationJoin is a repository whose collection a stage of the pipeline
+// reads, with the filter of its search rewrite hook.
+type aggregationJoin struct {
+	operator *repositoryOperator
+	selector interface{}
+}
+
+// resolveStages applies the search rewrite hooks of the repositories joined
+// by the $lookup and $unionWith stages, including those nested in $facet and
+// in the joined pipelines, returning the rewritten stages and the joins.
+func (self *repositoryOperator) resolveStages(stages []interface{}) ([]interface{}, []aggregationJoin, error) {
+	var joins []aggregationJoin
+	resolved := make([]interface{}, len(stages))
+
+	for i, stage := range stages {
+		resolved[i] = stage
+
+		name, value := stageOperator(stage)
+		switch name {
+		case "$lookup", "$unionWith":
+			key := "from"
+			if name == "$unionWith" {
+				key = "coll"
+				if coll, ok := value.(string); ok {
+					value = bson.M{"coll": coll}
+				}
+			}
+			spec := stageSpec(value)
+			if spec == nil {
+				continue
+			}
+
+			pipeline, nested, err := self.resolveStages(pipelineStages(spec["pipeline"]))
+			if err != nil {
+				return nil, nil, err
+			}
+			joins = append(joins, nested...)
+
+			collection, _ := spec[key].(string)
+			repository := lookupRepository(nil, collection)
+			if repository == nil {
+				if len(nested) > 0 {
+					spec["pipeline"] = pipeline
+					resolved[i] = bson.D{{Name: name, Value: spec}}
+				}
+				continue
+			}
+
+			join := &repositoryOperator{repository: repository, context: self.context, ctx: self.ctx}
+			selector, err := join.rewrite(OperationSearch, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+			joins = append(joins, aggregationJoin{operator: join, selector: selector})
+
+			if selector != nil {
+				pipeline = matchStages(pipeline, selector)
+			}
+			if selector != nil || len(nested) > 0 {
+				spec["pipeline"] = pipeline
+				resolved[i] = bson.D{{Name: name, Value: spec}}
+			}
+
+		case "$facet":
+			spec := stageSpec(value)
+			if spec == nil {
+				continue
+			}
+
+			var facetJoins []aggregationJoin
+			for facet, pipeline := range spec {
+				pipeline, nested, err := self.resolveStages(pipelineStages(pipeline))
+				if err != nil {
+					return nil, nil, err
+				}
+				spec[facet] = pipeline
+				facetJoins = append(facetJoins, nested...)
+			}
+			if len(facetJoins) > 0 {
+				joins = append(joins, facetJoins...)
+				resolved[i] = bson.D{{Name: name, Value: spec}}
+			}
+		}
+	}
+
+	return resolved, joins, nil
+}
+
+// matchStages returns stages restricted to the documents matching selector.
+// A leading $geoNear has to remain the first stage, so selector is added to
+// its query rather than matched ahead of it.
+func matchStages(stages []interface{}, selector interface{}) []interface{} {
+	if len(stages) > 0 {
+		if name, value := stageOperator(stages[0]); name == "$geoNear" {
+			if spec := stageSpec(value); spec != nil {
+				if query, ok := spec["query"]; ok && query != nil {
+					spec["query"] = bson.M{"$and": []interface{}{query, selector}}
+				} else {
+					spec["query"] = selector
+				}
+
+				resolved := append([]interface{}{}, stages...)
+				resolved[0] = bson.D{{Name: name, Value: spec}}
+				return resolved
+			}
+		}
+	}
+	return append([]interface{}{bson.M{"$match": selector}}, stages...)
+}
+
+// stageOperator returns the operator and the value of stage, or an empty
+// name when stage isn't a document with a single field.
+func stageOperator(stage interface{}) (string, interface{}) {
+	switch stage := stage.(type) {
+	case bson.D:
+		if len(stage) == 1 {
+			return stage[0].Name, stage[0].Value
+		}
+	case bson.M:
+		return stageOperator(map[string]interface{}(stage))
+	case map[string]interface{}:
+		if len(stage) == 1 {
+			for name, value := range stage {
+				return name, value
+			}
+		}
+	}
+	return "", nil
+}
+
+// stageSpec returns a copy of the document value of a stage, so it may be
+// modified without touching the pipeline of the caller, or nil when value
+// isn't a document.
+func stageSpec(value interface{}) bson.M {
+	spec := bson.M{}
+	switch value := value.(type) {
+	case bson.M:
+		for name, v := range value {
+			spec[name] = v
+		}
+	case map[string]interface{}:
+		for name, v := range value {
+			spec[name] = v
+		}
+	case bson.D:
+		for _, elem := range value {
+			spec[elem.Name] = elem.Value
+		}
+	default:
+		return nil
+	}
+	return spec
+}
+
+func (self *aggregation) all(result interface{}) error {
+	resultv := reflect.ValueOf(result)
+
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+
+	iter := self.iter()
+	slicev, err := self.operator.decodeAll(iter.Next, iter.Close, resultv.Elem(), self.collectErrors)
+	if !slicev.IsValid() {
+		return err
+	}
+
+	resultv.Elem().Set(slicev)
+
+	return err
+}
+
+// One unmarshals the first result into result. It returns mgo.ErrNotFound
+// when the pipeline produces no documents.
+func (self *aggregation) One(result interface{}) error {
+	return self.run(result, func() error {
+		return self.one(result)
+	})
+}
+
+func (self *aggregation) one(result interface{}) error {
+	iter := self.iter()
+
+	var raw bson.Raw
+	if !iter.Next(&raw) {
+		if err := iter.Close(); err != nil {
+			return err
+		}
+		return mgo.ErrNotFound
+	}
+
+	err := self.operator.decode(&raw, result)
+	if closeErr := iter.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// GetAll returns the results as a slice of the repository type.
+func (self *aggregation) GetAll() (interface{}, error) {
+	typ := self.operator.repository.typE
+	slicep := reflect.New(reflect.SliceOf(typ))
+	slicep.Elem().Set(reflect.MakeSlice(reflect.SliceOf(typ), 0, 0))
+
+	if err := self.All(slicep.Interface()); err != nil {
+		return nil, err
+	}
+	return slicep.Elem().Interface(), nil
+}
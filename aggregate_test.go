@@ -0,0 +1,116 @@
+package mongo
+
+import (
+	"github.com/go4r/handy"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+)
+
+type aggregateTestDocument struct {
+	Id bson.ObjectId `bson:"_id"`
+}
+
+var aggregateTestSearches []interface{}
+
+func (*aggregateTestDocument) HookRewriteSearch(c *handy.Context, selector interface{}) (interface{}, error) {
+	return bson.M{"tenant": "own"}, nil
+}
+
+func (*aggregateTestDocument) HookOnSearch(c *handy.Context, selector interface{}) error {
+	aggregateTestSearches = append(aggregateTestSearches, selector)
+	return nil
+}
+
+type aggregateTestJoined struct {
+	Id bson.ObjectId `bson:"_id"`
+}
+
+func (*aggregateTestJoined) HookRewriteSearch(c *handy.Context, selector interface{}) (interface{}, error) {
+	return bson.M{"tenant": "joined"}, nil
+}
+
+func (*aggregateTestJoined) HookOnSearch(c *handy.Context, selector interface{}) error {
+	aggregateTestSearches = append(aggregateTestSearches, selector)
+	return nil
+}
+
+func TestAggregationRewrite(t *testing.T) {
+	NewRepositoryCollection("aggregate_test_joined", &aggregateTestJoined{})
+
+	lookup := bson.M{"from": "aggregate_test_joined", "localField": "ref", "foreignField": "_id", "as": "refs"}
+	near := bson.M{"near": []float64{0, 0}, "distanceField": "distance", "query": bson.M{"kind": "shop"}}
+
+	tests := []struct {
+		name     string
+		pipeline *Pipeline
+		want     []interface{}
+	}{
+		{
+			"match ahead",
+			NewPipeline().Limit(1),
+			[]interface{}{bson.M{"$match": bson.M{"tenant": "own"}}, bson.D{{Name: "$limit", Value: 1}}},
+		},
+		{
+			"within $geoNear",
+			NewPipeline().Stage("$geoNear", near),
+			[]interface{}{bson.D{{Name: "$geoNear", Value: bson.M{
+				"near":          []float64{0, 0},
+				"distanceField": "distance",
+				"query":         bson.M{"$and": []interface{}{bson.M{"kind": "shop"}, bson.M{"tenant": "own"}}},
+			}}}},
+		},
+		{
+			"joined repository",
+			NewPipeline().Lookup("aggregate_test_joined", "ref", "_id", "refs"),
+			[]interface{}{
+				bson.M{"$match": bson.M{"tenant": "own"}},
+				bson.D{{Name: "$lookup", Value: bson.M{
+					"from":         "aggregate_test_joined",
+					"localField":   "ref",
+					"foreignField": "_id",
+					"as":           "refs",
+					"pipeline":     []interface{}{bson.M{"$match": bson.M{"tenant": "joined"}}},
+				}}},
+			},
+		},
+		{
+			"joined within $facet",
+			NewPipeline().Facet(map[string]*Pipeline{"refs": NewPipeline().Stage("$lookup", lookup)}),
+			[]interface{}{
+				bson.M{"$match": bson.M{"tenant": "own"}},
+				bson.D{{Name: "$facet", Value: bson.M{"refs": []interface{}{
+					bson.D{{Name: "$lookup", Value: bson.M{
+						"from":         "aggregate_test_joined",
+						"localField":   "ref",
+						"foreignField": "_id",
+						"as":           "refs",
+						"pipeline":     []interface{}{bson.M{"$match": bson.M{"tenant": "joined"}}},
+					}}},
+				}}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		aggregateTestSearches = nil
+
+		a := testOperator(&aggregateTestDocument{}).Aggregate(test.pipeline)
+		if err := a.run(nil, func() error { return nil }); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(a.resolved, test.want) {
+			t.Errorf("%s: pipeline %v, want %v", test.name, a.resolved, test.want)
+		}
+		if !reflect.DeepEqual(aggregateTestSearches[0], bson.M{"tenant": "own"}) {
+			t.Errorf("%s: HookOnSearch got %v, want the rewritten selector", test.name, aggregateTestSearches[0])
+		}
+	}
+
+	if len(aggregateTestSearches) != 2 || !reflect.DeepEqual(aggregateTestSearches[1], bson.M{"tenant": "joined"}) {
+		t.Errorf("the joined HookOnSearch got %v", aggregateTestSearches[1:])
+	}
+	if _, ok := lookup["pipeline"]; ok {
+		t.Error("the stage of the caller was modified")
+	}
+}
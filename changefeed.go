@@ -0,0 +1,397 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// CheckpointCollection is the collection holding the positions reached by
+// the ChangeFeeds in the oplog.
+var CheckpointCollection = "mongo.checkpoints"
+
+// ErrNoOplog is returned by a ChangeFeed when the server keeps no oplog,
+// that is when it's not a member of a replica set.
+var ErrNoOplog = errors.New("mongo: the server has no oplog, it must run as a replica set member")
+
+// ErrCheckpointLost is returned by a ChangeFeed whose saved position is
+// older than the oldest entry of the oplog: the changes in between are
+// lost, and the feed runs again once Reset, after its consumers caught up
+// by other means.
+var ErrCheckpointLost = errors.New("mongo: the change feed position is no longer in the oplog")
+
+// oplogEntry is an entry of the replica set oplog.
+type oplogEntry struct {
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Operation string              `bson:"op"`
+	Namespace string              `bson:"ns"`
+	Object    bson.Raw            `bson:"o"`
+	Selector  bson.M              `bson:"o2,omitempty"`
+}
+
+// applyOps is the command logged for the writes of a server-side
+// transaction, or of an applyOps run by a client.
+type applyOps struct {
+	Entries []*oplogEntry `bson:"applyOps"`
+}
+
+// key returns the _id selector of the document of an insert or delete.
+func (entry *oplogEntry) key() bson.M {
+	id, _ := rawField(&entry.Object, "_id")
+	return bson.M{"_id": id}
+}
+
+// oplogRepository queries the oplog. It's not registered, so it's unknown
+// to the populate machinery.
+var oplogRepository = &repository{collection: "oplog.rs", typE: reflect.TypeOf(oplogEntry{}), nilInst: &oplogEntry{}}
+
+// checkpoint is the position of a ChangeFeed.
+type checkpoint struct {
+	Name      string              `bson:"_id"`
+	Timestamp bson.MongoTimestamp `bson:"ts"`
+	Updated   time.Time           `bson:"updated"`
+}
+
+// ChangeFeed follows the oplog of the replica set, delivering the inserts,
+// updates and deletes of the repositories to Handler as ChangeEvents,
+// whichever process wrote them.
+//
+// Its position is saved under Name in the CheckpointCollection, so a feed
+// run again resumes where the previous run stopped, and a change whose
+// handling failed is delivered again. The first run starts at the end of
+// the oplog:
+//
+//     feed := mongo.NewChangeFeed(mongo.MongoSession, "search-index", func(e *mongo.ChangeEvent) error {
+//             return index.Apply(e)
+//     })
+//     feed.Collections = []string{"users", "posts"}
+//     go feed.Run(ctx)
+//
+// The events are decoded from the oplog as written, without any request,
+// so no hook runs on them, and the query of the oplog goes through the
+// global middlewares with a nil Context, see Use. After holds the inserted
+// document and the replacement document of the updates, decoded into the
+// type of the repository, or the update operators as a bson.M when the
+// update wasn't a replacement, unless Lookup is set. Before is always nil,
+// as the oplog keeps no previous version of the documents. Key holds the
+// _id selector. The entries which can't be decoded are handed to
+// OnDecodeError, so that a document the type of its repository can't hold
+// doesn't stop the feed on every run.
+//
+// The writes of the server-side transactions of the other clients, logged
+// together as an applyOps command, are delivered one by one; all of them
+// are delivered again when Handler fails on one.
+type ChangeFeed struct {
+	Session  *mgo.Session
+	Database string
+	Name     string
+	Handler  func(e *ChangeEvent) error
+
+	// Collections are the collections of the repositories followed, every
+	// registered repository when empty.
+	Collections []string
+	// Lookup makes the updates carry the current document, read once the
+	// change is received, rather than the update operators. It's nil when
+	// the document was deleted since.
+	Lookup bool
+	// Timeout is the delay at which the context is checked while waiting
+	// for changes, raised to 100ms.
+	Timeout time.Duration
+	// CheckpointInterval is the minimum delay between two saves of the
+	// position, which is saved as well when the feed stops.
+	CheckpointInterval time.Duration
+	// OnDecodeError receives the oplog entries of namespace whose object
+	// can't be decoded, along with the error. The entry is skipped when it
+	// returns nil, and stops the feed with its error otherwise, to be
+	// delivered again on the next run. The entries are logged and skipped
+	// when it's nil.
+	OnDecodeError func(namespace string, object bson.Raw, err error) error
+}
+
+func NewChangeFeed(session *mgo.Session, name string, handler func(e *ChangeEvent) error) *ChangeFeed {
+	return &ChangeFeed{
+		Session:            session,
+		Database:           MongoDBName,
+		Name:               name,
+		Handler:            handler,
+		Timeout:            5 * time.Second,
+		CheckpointInterval: time.Second,
+	}
+}
+
+// Run delivers the changes until ctx is done or Handler fails, returning
+// the error which stopped it.
+func (f *ChangeFeed) Run(ctx context.Context) error {
+	session := f.Session.Copy()
+	defer session.Close()
+
+	checkpoints := session.DB(f.Database).C(CheckpointCollection)
+	oplog := session.DB("local").C(oplogRepository.collection)
+
+	position, err := f.position(checkpoints, oplog)
+	if err != nil {
+		return err
+	}
+
+	operator := &repositoryOperator{repository: oplogRepository, collection: oplog, ctx: ctx}
+	namespaces := f.namespaces()
+	selector := bson.M{"$or": []bson.M{
+		{"ns": bson.M{"$in": namespaces}, "op": bson.M{"$in": []string{"i", "u", "d"}}},
+		{"ns": "admin.$cmd", "op": "c", "o.applyOps": bson.M{"$exists": true}},
+	}}
+	iter := operator.Search(selector).LogReplay().tail(f.Timeout, "ts", position)
+
+	saved, savedAt := position, time.Now()
+	entry := &oplogEntry{}
+	for iter.Next(entry) {
+		err := f.deliver(session, entry, namespaces)
+		if err != nil {
+			iter.Close()
+			f.save(checkpoints, saved, position)
+			return err
+		}
+
+		position = entry.Timestamp
+		if time.Since(savedAt) >= f.CheckpointInterval {
+			if err := f.save(checkpoints, saved, position); err != nil {
+				iter.Close()
+				return err
+			}
+			saved, savedAt = position, time.Now()
+		}
+		entry = &oplogEntry{}
+	}
+
+	err = iter.Close()
+	if err := f.save(checkpoints, saved, position); err != nil {
+		return err
+	}
+	return err
+}
+
+// deliver runs Handler on the changes of entry, the writes of an applyOps
+// on the namespaces followed.
+func (f *ChangeFeed) deliver(session *mgo.Session, entry *oplogEntry, namespaces []string) error {
+	entries := []*oplogEntry{entry}
+	if entry.Operation == "c" {
+		ops := &applyOps{}
+		if err := entry.Object.Unmarshal(ops); err != nil {
+			return f.decodeFailed(entry, err)
+		}
+
+		entries = entries[:0]
+		for _, op := range ops.Entries {
+			for _, namespace := range namespaces {
+				if op.Namespace == namespace {
+					op.Timestamp = entry.Timestamp
+					entries = append(entries, op)
+					break
+				}
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		change, err := f.change(session, entry)
+		var decodeErr *changeDecodeError
+		if errors.As(err, &decodeErr) {
+			change, err = nil, f.decodeFailed(entry, decodeErr.err)
+		}
+		if err == nil && change != nil {
+			err = f.Handler(change)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeFailed applies OnDecodeError to the entry which failed to decode
+// with err.
+func (f *ChangeFeed) decodeFailed(entry *oplogEntry, err error) error {
+	if f.OnDecodeError != nil {
+		return f.OnDecodeError(entry.Namespace, entry.Object, err)
+	}
+	log.Printf("mongo: change feed %s skipped an entry of %s: %v", f.Name, entry.Namespace, err)
+	return nil
+}
+
+// changeDecodeError is the failure to decode an oplog entry.
+type changeDecodeError struct {
+	err error
+}
+
+func (e *changeDecodeError) Error() string {
+	return e.err.Error()
+}
+
+func decodeFailure(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &changeDecodeError{err}
+}
+
+// Position returns the position saved for the feed, zero when it never ran.
+func (f *ChangeFeed) Position() (bson.MongoTimestamp, error) {
+	session := f.Session.Copy()
+	defer session.Close()
+
+	saved := &checkpoint{}
+	err := session.DB(f.Database).C(CheckpointCollection).FindId(f.Name).One(saved)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return saved.Timestamp, err
+}
+
+// Reset moves the feed to position, from which its next run resumes.
+func (f *ChangeFeed) Reset(position bson.MongoTimestamp) error {
+	session := f.Session.Copy()
+	defer session.Close()
+
+	return f.save(session.DB(f.Database).C(CheckpointCollection), -1, position)
+}
+
+// position returns the saved position, or the last entry of the oplog.
+func (f *ChangeFeed) position(checkpoints, oplog *mgo.Collection) (bson.MongoTimestamp, error) {
+	saved := &checkpoint{}
+	err := checkpoints.FindId(f.Name).One(saved)
+	if err == nil {
+		first := &oplogEntry{}
+		err = oplog.Find(nil).Sort("$natural").One(first)
+		switch {
+		case err == mgo.ErrNotFound:
+			return 0, ErrNoOplog
+		case err != nil:
+			return 0, err
+		case first.Timestamp > saved.Timestamp:
+			return 0, ErrCheckpointLost
+		}
+		return saved.Timestamp, nil
+	}
+	if err != mgo.ErrNotFound {
+		return 0, err
+	}
+
+	last := &oplogEntry{}
+	err = oplog.Find(nil).Sort("-$natural").One(last)
+	if err == mgo.ErrNotFound {
+		return 0, ErrNoOplog
+	}
+	return last.Timestamp, err
+}
+
+// save saves position unless it's the one saved already.
+func (f *ChangeFeed) save(checkpoints *mgo.Collection, saved, position bson.MongoTimestamp) error {
+	if position == saved {
+		return nil
+	}
+
+	_, err := checkpoints.UpsertId(f.Name, bson.M{"$set": bson.M{"ts": position, "updated": time.Now()}})
+	return err
+}
+
+// namespaces returns the namespaces of the collections followed.
+func (f *ChangeFeed) namespaces() []string {
+	collections := f.Collections
+	if len(collections) == 0 {
+		repositoriesMutex.RLock()
+		for collection := range repositoriesByCollection {
+			collections = append(collections, collection)
+		}
+		repositoriesMutex.RUnlock()
+	}
+
+	namespaces := make([]string, len(collections))
+	for i, collection := range collections {
+		namespaces[i] = f.Database + "." + collection
+	}
+	return namespaces
+}
+
+// change returns the ChangeEvent of entry, nil when it's not a change of a
+// document.
+func (f *ChangeFeed) change(session *mgo.Session, entry *oplogEntry) (*ChangeEvent, error) {
+	collection := strings.TrimPrefix(entry.Namespace, f.Database+".")
+
+	change := &ChangeEvent{
+		Collection: collection,
+		// The high 32 bits of a timestamp are seconds since the epoch.
+		Time: time.Unix(int64(entry.Timestamp>>32), 0),
+	}
+
+	var fields bson.RawD
+	if err := entry.Object.Unmarshal(&fields); err != nil {
+		return nil, decodeFailure(err)
+	}
+
+	switch entry.Operation {
+	case "i":
+		change.Operation = OperationInsert
+		after, err := f.decode(collection, &entry.Object)
+		if err != nil {
+			return nil, decodeFailure(err)
+		}
+		change.After = after
+		change.Key = entry.key()
+	case "u":
+		change.Operation = OperationUpdate
+		change.Key = bson.M{"_id": entry.Selector["_id"]}
+
+		switch {
+		case f.Lookup:
+			raw := &bson.Raw{}
+			err := session.DB(f.Database).C(collection).Find(change.Key).One(raw)
+			if err == nil {
+				change.After, err = f.decode(collection, raw)
+				err = decodeFailure(err)
+			}
+			if err != nil && err != mgo.ErrNotFound {
+				return nil, err
+			}
+		case len(fields) > 0 && strings.HasPrefix(fields[0].Name, "$"):
+			update := bson.M{}
+			if err := entry.Object.Unmarshal(&update); err != nil {
+				return nil, decodeFailure(err)
+			}
+			change.After = update
+		default:
+			after, err := f.decode(collection, &entry.Object)
+			if err != nil {
+				return nil, decodeFailure(err)
+			}
+			change.After = after
+		}
+	case "d":
+		change.Operation = OperationDelete
+		change.Key = entry.key()
+	default:
+		return nil, nil
+	}
+
+	return change, nil
+}
+
+// decode unmarshals raw into a new document of the repository stored in
+// collection, or into a bson.M when it's not registered.
+func (f *ChangeFeed) decode(collection string, raw *bson.Raw) (interface{}, error) {
+	var doc interface{} = &bson.M{}
+	if repository := lookupRepository(nil, collection); repository != nil {
+		doc = reflect.New(repository.typE).Interface()
+	}
+
+	if err := raw.Unmarshal(doc); err != nil {
+		return nil, err
+	}
+	if m, is := doc.(*bson.M); is {
+		return *m, nil
+	}
+	return doc, nil
+}
@@ -0,0 +1,47 @@
+package mongo
+
+import (
+	"errors"
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+func TestChangeFeedDecodeError(t *testing.T) {
+	data, err := bson.Marshal(bson.M{"_id": 1, "name": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := &oplogEntry{Operation: "i", Namespace: "test.feed_tests", Object: bson.Raw{Kind: 0x03, Data: data}}
+	corrupt := &oplogEntry{Operation: "i", Namespace: "test.feed_tests", Object: bson.Raw{Kind: 0x03, Data: []byte{5, 0, 0}}}
+	namespaces := []string{"test.feed_tests"}
+
+	var delivered []*ChangeEvent
+	f := NewChangeFeed(nil, "tests", func(e *ChangeEvent) error {
+		delivered = append(delivered, e)
+		return nil
+	})
+	f.Database = "test"
+
+	if err := f.deliver(nil, corrupt, namespaces); err != nil {
+		t.Fatalf("deliver() = %v, want the entry skipped", err)
+	}
+	if err := f.deliver(nil, valid, namespaces); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 1 || delivered[0].Operation != OperationInsert {
+		t.Fatalf("delivered %v, want the valid insert only", delivered)
+	}
+
+	errStop := errors.New("stop")
+	var namespace string
+	f.OnDecodeError = func(ns string, object bson.Raw, err error) error {
+		namespace = ns
+		return errStop
+	}
+	if err := f.deliver(nil, corrupt, namespaces); err != errStop {
+		t.Fatalf("deliver() = %v, want the error of OnDecodeError", err)
+	}
+	if namespace != "test.feed_tests" {
+		t.Fatalf("OnDecodeError got the namespace %q", namespace)
+	}
+}
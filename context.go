@@ -0,0 +1,274 @@
+package mongo
+
+import (
+	"context"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"time"
+)
+
+// StdContext returns the context.Context bounding the operations of the
+// operator. Unless replaced through WithContext it is the request context
+// returned by CStdContext.
+func (self *repositoryOperator) StdContext() context.Context {
+	return self.ctx
+}
+
+// WithContext returns a copy of the operator whose operations are bound to
+// ctx. Operations fail with ctx.Err() once ctx is done: they are checked
+// before being sent, iterations stop between documents, and when ctx has
+// a deadline the socket timeout of a dedicated session copy and the
+// maxTimeMS of the queries, counts, findAndModify and aggregations are set
+// to the remaining time, so the server stops them as well.
+//
+// For example:
+//
+//     ctx, cancel := context.WithTimeout(mongo.CStdContext(r), 2*time.Second)
+//     defer cancel()
+//     users := Users(r).WithContext(ctx).Search(nil).GetAll()
+//
+func (self *repositoryOperator) WithContext(ctx context.Context) *repositoryOperator {
+	collection := self.collection
+
+	if deadline, ok := ctx.Deadline(); ok {
+		session := collection.Database.Session.Copy()
+		if remaining := time.Until(deadline); remaining > 0 {
+			session.SetSocketTimeout(remaining)
+			session.SetSyncTimeout(remaining)
+		}
+		self.context.CleanupFunc(session.Close)
+		collection = collection.With(session)
+	}
+
+	return &repositoryOperator{
+		repository: self.repository,
+		context:    self.context,
+		collection: collection,
+		ctx:        ctx,
+	}
+}
+
+// maxTimeMS returns the time left before the context deadline in
+// milliseconds, or zero when the context has no deadline.
+func (self *repositoryOperator) maxTimeMS() int64 {
+	deadline, ok := self.ctx.Deadline()
+	if !ok {
+		return 0
+	}
+
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining < 1 {
+		remaining = 1
+	}
+	return remaining
+}
+
+// read builds the mgo query reading the documents of selector. When the
+// context has a deadline, the time left is sent as $maxTimeMS so that the
+// server stops the query as well. mgo has no option for it, so the query
+// modifiers are written in the selector, unless Hint or Snapshot made mgo
+// write its own.
+func (self *query) read(selector interface{}, sort []string, skip, limit int) *mgo.Query {
+	var q *mgo.Query
+
+	if maxTime := self.operator.maxTimeMS(); maxTime > 0 && !self.modifiers {
+		if selector == nil {
+			selector = bson.D{}
+		}
+		wrapped := bson.D{
+			{Name: "$query", Value: selector},
+			{Name: "$maxTimeMS", Value: maxTime},
+		}
+		if len(sort) > 0 {
+			wrapped = append(wrapped, bson.DocElem{Name: "$orderby", Value: sortDocument(sort)})
+		}
+		q = self.derive(wrapped)
+	} else {
+		q = self.derive(selector)
+		if len(sort) > 0 {
+			q.Sort(sort...)
+		}
+	}
+
+	if skip > 0 {
+		q.Skip(skip)
+	}
+	if limit > 0 {
+		q.Limit(limit)
+	}
+	return q
+}
+
+// count counts the documents of selector, with the maxTimeMS of the context
+// deadline.
+func (self *repositoryOperator) count(selector interface{}, skip, limit int) (int, error) {
+	cmd := bson.D{{Name: "count", Value: self.collection.Name}}
+	if selector != nil {
+		cmd = append(cmd, bson.DocElem{Name: "query", Value: selector})
+	}
+	if limit > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "limit", Value: limit})
+	}
+	if skip > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "skip", Value: skip})
+	}
+	if maxTime := self.maxTimeMS(); maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: maxTime})
+	}
+
+	var result struct {
+		N int `bson:"n"`
+	}
+	err := self.collection.Database.Run(cmd, &result)
+	return result.N, err
+}
+
+// findAndModify applies change to the first document of selector in the
+// sort order as mgo's Query.Apply does, with the maxTimeMS of the context
+// deadline.
+func (self *repositoryOperator) findAndModify(selector interface{}, sort []string, fields interface{}, change mgo.Change, result interface{}) (*mgo.ChangeInfo, error) {
+	cmd := bson.D{{Name: "findAndModify", Value: self.collection.Name}}
+	if selector != nil {
+		cmd = append(cmd, bson.DocElem{Name: "query", Value: selector})
+	}
+	if len(sort) > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "sort", Value: sortDocument(sort)})
+	}
+	if fields != nil {
+		cmd = append(cmd, bson.DocElem{Name: "fields", Value: fields})
+	}
+	if change.Remove {
+		cmd = append(cmd, bson.DocElem{Name: "remove", Value: true})
+	} else {
+		cmd = append(cmd,
+			bson.DocElem{Name: "update", Value: change.Update},
+			bson.DocElem{Name: "new", Value: change.ReturnNew},
+			bson.DocElem{Name: "upsert", Value: change.Upsert},
+		)
+	}
+	if maxTime := self.maxTimeMS(); maxTime > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "maxTimeMS", Value: maxTime})
+	}
+
+	// As findAndModify writes, it runs on the primary.
+	session := self.collection.Database.Session.Clone()
+	defer session.Close()
+	session.SetMode(mgo.Strong, false)
+
+	var doc struct {
+		Value     bson.Raw `bson:"value"`
+		LastError struct {
+			N               int         `bson:"n"`
+			UpdatedExisting bool        `bson:"updatedExisting"`
+			UpsertedId      interface{} `bson:"upserted"`
+		} `bson:"lastErrorObject"`
+	}
+	err := self.collection.Database.With(session).Run(cmd, &doc)
+	if qerr, is := err.(*mgo.QueryError); is && qerr.Message == "No matching object found" {
+		return nil, mgo.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if doc.LastError.N == 0 {
+		return nil, mgo.ErrNotFound
+	}
+
+	if doc.Value.Kind != 0x0A && result != nil {
+		if err := doc.Value.Unmarshal(result); err != nil {
+			return nil, err
+		}
+	}
+
+	info := &mgo.ChangeInfo{}
+	switch {
+	case doc.LastError.UpdatedExisting:
+		info.Updated = doc.LastError.N
+	case change.Remove:
+		info.Removed = doc.LastError.N
+	case change.Upsert:
+		info.UpsertedId = doc.LastError.UpsertedId
+	}
+	return info, nil
+}
+
+// requestContext is the context of the operations of a request, returned by
+// the "mongo.context" provider. The repositories may be used with the
+// handy.Context before being passed the *http.Request, so the context of
+// the request is bound as its parent once known: from then on it carries
+// its deadline and values, and it's cancelled along with it.
+type requestContext struct {
+	mutex  sync.Mutex
+	parent context.Context
+	done   chan struct{}
+	err    error
+}
+
+func newRequestContext() *requestContext {
+	return &requestContext{done: make(chan struct{})}
+}
+
+// bind makes parent the parent of the context, unless it already has one.
+func (self *requestContext) bind(parent context.Context) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.parent != nil || self.err != nil {
+		return
+	}
+	self.parent = parent
+
+	if err := parent.Err(); err != nil {
+		self.err = err
+		close(self.done)
+		return
+	}
+	if parent.Done() != nil {
+		go func() {
+			select {
+			case <-parent.Done():
+				self.cancel(parent.Err())
+			case <-self.done:
+			}
+		}()
+	}
+}
+
+// cancel ends the context with err, unless it's already done.
+func (self *requestContext) cancel(err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.err == nil {
+		self.err = err
+		close(self.done)
+	}
+}
+
+func (self *requestContext) Deadline() (time.Time, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.parent == nil {
+		return time.Time{}, false
+	}
+	return self.parent.Deadline()
+}
+
+func (self *requestContext) Done() <-chan struct{} {
+	return self.done
+}
+
+func (self *requestContext) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.err
+}
+
+func (self *requestContext) Value(key interface{}) interface{} {
+	self.mutex.Lock()
+	parent := self.parent
+	self.mutex.Unlock()
+	if parent == nil {
+		return nil
+	}
+	return parent.Value(key)
+}
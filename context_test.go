@@ -0,0 +1,49 @@
+package mongo
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRequestContextBind(t *testing.T) {
+	ctx := newRequestContext()
+	if _, ok := ctx.Deadline(); ok || ctx.Err() != nil {
+		t.Fatal("an unbound context has a deadline or is done")
+	}
+
+	deadline := time.Now().Add(time.Hour)
+	parent, cancel := context.WithDeadline(context.Background(), deadline)
+	ctx.bind(parent)
+	ctx.bind(context.Background())
+
+	if got, ok := ctx.Deadline(); !ok || !got.Equal(deadline) {
+		t.Fatalf("deadline %v, want the one of the request %v", got, deadline)
+	}
+
+	cancel()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the context isn't cancelled along with the request")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("error %v, want context.Canceled", ctx.Err())
+	}
+}
+
+func TestRequestContextCancel(t *testing.T) {
+	ctx := newRequestContext()
+	ctx.cancel(context.Canceled)
+
+	parent, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx.bind(parent)
+
+	if ctx.Err() != context.Canceled {
+		t.Fatalf("error %v, want context.Canceled", ctx.Err())
+	}
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("a context done before the request is bound to it")
+	}
+}
@@ -0,0 +1,231 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go4r/handy"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"reflect"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// HookAsync is implemented by the document types whose after hooks
+// (HookAfterInsert, HookAfterUpdate, HookAfterSave, HookAfterDelete and
+// HookAfterModify) should run on the AsyncHooks dispatcher once the write
+// succeeded, instead of delaying the operation.
+//
+// As the request may be over by the time they run, the hooks receive the
+// detached *handy.Context returned by the NewContext function of the
+// dispatcher, and a copy of the document decoded from its BSON so that the
+// caller may keep changing it: their errors don't reach the client. They
+// run synchronously, on the context of the request as the other hooks,
+// while NewContext is nil, once the dispatcher is shut down or while its
+// queue is full.
+type HookAsync interface {
+	HookAsync() bool
+}
+
+var (
+	ErrDispatcherClosed = errors.New("mongo: dispatcher is shut down")
+	ErrQueueFull        = errors.New("mongo: dispatcher queue is full")
+)
+
+// AsyncHooks is the dispatcher running the after hooks of the HookAsync
+// documents. Its workers start with the first job.
+var AsyncHooks = NewDispatcher(runtime.NumCPU(), 1024)
+
+// Dispatcher runs jobs on a bounded pool of workers, retrying the failing
+// ones with an exponential backoff and handing the ones still failing to
+// DeadLetter.
+type Dispatcher struct {
+	// Retries is the number of times a failing job is retried.
+	Retries int
+	// Backoff is the delay before the first retry, doubled on each retry.
+	Backoff time.Duration
+	// DeadLetter receives the jobs failing after every retry. It defaults
+	// to logging them.
+	DeadLetter func(name string, err error)
+	// NewContext returns the handy context the after hooks of the
+	// HookAsync documents run with, detached from the request, and the
+	// function releasing it once the hook returned.
+	NewContext func() (c *handy.Context, release func())
+
+	workers   int
+	start     sync.Once
+	jobs      chan dispatcherJob
+	mutex     sync.RWMutex
+	closed    bool
+	wg        sync.WaitGroup
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+type dispatcherJob struct {
+	name string
+	run  func() error
+}
+
+// NewDispatcher returns a dispatcher running up to workers jobs at once,
+// with room for queueSize jobs waiting. The workers start with the first
+// job.
+func NewDispatcher(workers, queueSize int) *Dispatcher {
+	if workers < 1 {
+		workers = 1
+	}
+
+	return &Dispatcher{
+		Retries: 3,
+		Backoff: time.Second,
+		workers: workers,
+		jobs:    make(chan dispatcherJob, queueSize),
+		abort:   make(chan struct{}),
+	}
+}
+
+// Dispatch queues the job. It returns ErrQueueFull rather than waiting
+// when the queue is full, and ErrDispatcherClosed once Shutdown was called.
+func (d *Dispatcher) Dispatch(name string, job func() error) error {
+	d.start.Do(func() {
+		d.wg.Add(d.workers)
+		for i := 0; i < d.workers; i++ {
+			go d.work()
+		}
+	})
+
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.closed {
+		return ErrDispatcherClosed
+	}
+
+	select {
+	case d.jobs <- dispatcherJob{name, job}:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Shutdown stops accepting jobs and waits for the queued ones to be done,
+// or for ctx to be done. Once ctx is done, the failing jobs are handed to
+// DeadLetter rather than retried.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mutex.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.jobs)
+	}
+	d.mutex.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		d.abortOnce.Do(func() { close(d.abort) })
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+
+	for job := range d.jobs {
+		err := d.attempt(job)
+		backoff := d.Backoff
+		for retry := 0; err != nil && retry < d.Retries && d.wait(backoff); retry++ {
+			backoff *= 2
+			err = d.attempt(job)
+		}
+
+		if err != nil {
+			d.deadLetter(job.name, err)
+		}
+	}
+}
+
+// wait pauses for delay, returning false when the shutdown gave up waiting
+// for the jobs meanwhile.
+func (d *Dispatcher) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-d.abort:
+		return false
+	}
+}
+
+// attempt runs the job, turning a panic into an error.
+func (d *Dispatcher) attempt(job dispatcherJob) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.run()
+}
+
+func (d *Dispatcher) deadLetter(name string, err error) {
+	if d.DeadLetter != nil {
+		d.DeadLetter(name, err)
+		return
+	}
+	log.Printf("mongo: dispatched job %s failed: %v", name, err)
+}
+
+// after runs the after hook of doc, on AsyncHooks when doc asks for it, see
+// HookAsync.
+func (self *repositoryOperator) after(doc interface{}, hook string, run func(doc interface{}, c *handy.Context) error) error {
+	return dispatchAfter(self.repository.collection, self.context, doc, hook, run)
+}
+
+func dispatchAfter(collection string, c *handy.Context, doc interface{}, hook string, run func(doc interface{}, c *handy.Context) error) error {
+	newContext := AsyncHooks.NewContext
+	if async, is := doc.(HookAsync); is && async.HookAsync() && newContext != nil {
+		if copied, err := copyDocument(doc); err == nil {
+			err = AsyncHooks.Dispatch(collection+"."+hook, func() error {
+				c, release := newContext()
+				defer release()
+				return hookError(hook, run(copied, c))
+			})
+			if err != ErrDispatcherClosed && err != ErrQueueFull {
+				return err
+			}
+		}
+	}
+
+	return hookError(hook, run(doc, c))
+}
+
+// copyDocument returns a copy of the document doc, a pointer to a struct,
+// decoded from its BSON.
+func copyDocument(doc interface{}) (interface{}, error) {
+	value := reflect.ValueOf(doc)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return doc, nil
+	}
+
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := reflect.New(value.Elem().Type()).Interface()
+	if err := bson.Unmarshal(data, copied); err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
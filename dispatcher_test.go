@@ -0,0 +1,67 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"github.com/go4r/handy"
+	"testing"
+	"time"
+)
+
+func TestDispatcherShutdownAbortsRetries(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	d.Backoff = time.Hour
+
+	failed := make(chan error, 1)
+	d.DeadLetter = func(name string, err error) {
+		failed <- err
+	}
+
+	errJob := errors.New("job failed")
+	if err := d.Dispatch("job", func() error { return errJob }); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := d.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v, want the deadline", err)
+	}
+
+	select {
+	case err := <-failed:
+		if err != errJob {
+			t.Fatalf("dead letter of %v, want %v", err, errJob)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the job is still waiting for its retry")
+	}
+}
+
+type asyncTestDocument struct {
+	Name string
+}
+
+func (*asyncTestDocument) HookAsync() bool {
+	return true
+}
+
+func TestDispatchAfterWithoutNewContext(t *testing.T) {
+	c := &handy.Context{}
+	doc := &asyncTestDocument{Name: "a"}
+
+	var got *handy.Context
+	err := dispatchAfter("tests", c, doc, "HookAfterInsert", func(hooked interface{}, c *handy.Context) error {
+		if hooked != doc {
+			t.Error("the hook ran on a copy of the document")
+		}
+		got = c
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != c {
+		t.Fatal("the hook didn't run synchronously on the context of the request")
+	}
+}
@@ -0,0 +1,117 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo"
+	"net"
+)
+
+var (
+	// ErrNotFound is returned when no document matches the query.
+	ErrNotFound = mgo.ErrNotFound
+
+	// ErrHookAborted is matched by the errors returned when a hook aborts
+	// an operation, see HookError.
+	ErrHookAborted = errors.New("mongo: operation aborted by hook")
+
+	// ErrDuplicateKey is matched by the errors returned when a write
+	// violates a unique index. The mgo error is still reachable through
+	// errors.As.
+	ErrDuplicateKey = errors.New("mongo: duplicate key")
+
+	// ErrValidation is wrapped by the errors the hooks return for invalid
+	// documents, which Resource answers with 422 Unprocessable Entity:
+	//
+	//     return fmt.Errorf("%w: the name is required", mongo.ErrValidation)
+	//
+	ErrValidation = errors.New("mongo: invalid document")
+)
+
+// HookError is returned when a hook aborts an operation. It matches
+// ErrHookAborted and unwraps to the error returned by the hook.
+type HookError struct {
+	Hook string
+	Err  error
+}
+
+func (e *HookError) Error() string {
+	return "mongo: " + e.Hook + " aborted the operation: " + e.Err.Error()
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+func (e *HookError) Is(target error) bool {
+	return target == ErrHookAborted
+}
+
+// HookErrors is returned by the reads of queries running with
+// CollectHookErrors, listing the errors of the documents left out of the
+// result because one of their load hooks failed.
+type HookErrors []error
+
+func (e HookErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more hook errors)", e[0].Error(), len(e)-1)
+}
+
+func (e HookErrors) Unwrap() []error {
+	return e
+}
+
+func hookError(hook string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &HookError{Hook: hook, Err: err}
+}
+
+type duplicateKeyError struct {
+	err error
+}
+
+func (e *duplicateKeyError) Error() string {
+	return e.err.Error()
+}
+
+func (e *duplicateKeyError) Unwrap() error {
+	return e.err
+}
+
+func (e *duplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
+
+// wrapError translates the errors returned by mgo: the context error is
+// returned when the operation failed because the context was cancelled or
+// reached its deadline, and duplicate key errors match ErrDuplicateKey.
+func (self *repositoryOperator) wrapError(err error) error {
+	return wrapError(self.ctx, err)
+}
+
+func wrapError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		if _, ok := ctx.Deadline(); ok {
+			return context.DeadlineExceeded
+		}
+	}
+
+	if mgo.IsDup(err) {
+		return &duplicateKeyError{err}
+	}
+
+	return err
+}
@@ -0,0 +1,217 @@
+package mongo
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ErrPreconditionFailed is returned by the conditional writes when the
+// stored document doesn't match the ETag given, or changed meanwhile.
+var ErrPreconditionFailed = errors.New("mongo: precondition failed")
+
+// DocumentWithETag is implemented by the document types carrying a
+// version, such as a revision counter or a modification time, from which
+// their ETag is derived instead of their content.
+type DocumentWithETag interface {
+	ETag() string
+}
+
+// DocumentWithETagField is implemented by the DocumentWithETag types whose
+// ETag derives from a single stored field, such as a revision counter,
+// given by its name. The conditional writes then compare that field, which
+// the writes must change, instead of every field of the document.
+type DocumentWithETagField interface {
+	DocumentWithETag
+	ETagField() string
+}
+
+// ETag returns the strong entity tag of doc, quoted as in HTTP headers: its
+// ETag method when it implements DocumentWithETag, and otherwise the md5 of
+// its BSON encoding with the fields of every document sorted by name, so
+// that it's stable as long as the document is, even when it holds maps.
+func ETag(doc interface{}) (string, error) {
+	if doc, is := doc.(DocumentWithETag); is {
+		return `"` + doc.ETag() + `"`, nil
+	}
+
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	if data, err = sortedDocument(data, false); err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, nil
+}
+
+// sortedDocument returns the BSON document data with the fields of it and
+// of its embedded documents sorted by name. The elements of an array, whose
+// names are their indexes, keep their order.
+func sortedDocument(data []byte, array bool) ([]byte, error) {
+	var fields bson.RawD
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	if !array {
+		sort.SliceStable(fields, func(i, j int) bool {
+			return fields[i].Name < fields[j].Name
+		})
+	}
+
+	sorted := make(bson.D, len(fields))
+	for i, field := range fields {
+		value := field.Value
+		if value.Kind == 0x03 || value.Kind == 0x04 {
+			data, err := sortedDocument(value.Data, value.Kind == 0x04)
+			if err != nil {
+				return nil, err
+			}
+			value = bson.Raw{Kind: value.Kind, Data: data}
+		}
+		sorted[i] = bson.DocElem{Name: field.Name, Value: value}
+	}
+
+	return bson.Marshal(sorted)
+}
+
+// ETagMatches reports whether etag is listed in the If-Match or
+// If-None-Match header value header, using the weak comparison when weak
+// is set and the strong one otherwise.
+func ETagMatches(header, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag && etag != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateDocumentIfMatch updates doc provided the ETag of the stored
+// document is listed in ifMatch, an If-Match header value, and it didn't
+// change until the update. It fails with ErrPreconditionFailed otherwise,
+// and behaves as UpdateDocument when ifMatch is empty:
+//
+//     err := Users(r).UpdateDocumentIfMatch(user, r.Header.Get("If-Match"))
+//     if err == mongo.ErrPreconditionFailed {
+//             w.WriteHeader(http.StatusPreconditionFailed)
+//     }
+//
+func (self *repositoryOperator) UpdateDocumentIfMatch(doc DocumentWithPrimaryKey, ifMatch string) error {
+	if ifMatch == "" {
+		return self.UpdateDocument(doc)
+	}
+
+	condition, err := self.matchCondition(doc.PrimaryKey(self.context), ifMatch)
+	if err != nil {
+		return err
+	}
+	return self.update(doc.PrimaryKey(self.context), doc, condition)
+}
+
+// SaveDocumentIfMatch saves doc under the conditions of
+// UpdateDocumentIfMatch. As a missing document has no ETag, it never
+// inserts unless ifMatch is empty.
+func (self *repositoryOperator) SaveDocumentIfMatch(doc DocumentWithPrimaryKey, ifMatch string) error {
+	if ifMatch == "" {
+		return self.SaveDocument(doc)
+	}
+
+	condition, err := self.matchCondition(doc.PrimaryKey(self.context), ifMatch)
+	if err != nil {
+		return err
+	}
+	return self.save(doc, condition)
+}
+
+// matchCondition checks the ETag of the document selected by
+// document_selector against ifMatch, and returns the condition matching it
+// as long as it's unchanged, see etagCondition.
+func (self *repositoryOperator) matchCondition(document_selector interface{}, ifMatch string) (bson.D, error) {
+	document_selector, err := self.rewrite(OperationSearch, document_selector)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw bson.Raw
+	err = self.search(document_selector, func() error {
+		return self.wrapError(self.collection.Find(document_selector).One(&raw))
+	})
+	if err == ErrNotFound {
+		return nil, ErrPreconditionFailed
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Any existing document matches "*".
+	if strings.TrimSpace(ifMatch) == "*" {
+		return bson.D{}, nil
+	}
+
+	current := reflect.New(self.repository.typE).Interface()
+	if err := self.decode(&raw, current); err != nil {
+		return nil, err
+	}
+	etag, err := ETag(current)
+	if err != nil {
+		return nil, err
+	}
+	if !ETagMatches(ifMatch, etag, false) {
+		return nil, ErrPreconditionFailed
+	}
+	return etagCondition(&raw, current)
+}
+
+// etagCondition returns the condition matching the stored document raw,
+// decoded into current, as long as it's unchanged: the field its ETag
+// derives from equal to the stored one when current implements
+// DocumentWithETagField, and every field equal to the stored one otherwise.
+func etagCondition(raw *bson.Raw, current interface{}) (bson.D, error) {
+	if doc, is := current.(DocumentWithETagField); is {
+		var stored bson.M
+		if err := raw.Unmarshal(&stored); err != nil {
+			return nil, err
+		}
+		field := doc.ETagField()
+		return bson.D{{Name: field, Value: storedValue(stored, field)}}, nil
+	}
+
+	var fields bson.RawD
+	if err := raw.Unmarshal(&fields); err != nil {
+		return nil, err
+	}
+
+	condition := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		condition = append(condition, bson.DocElem{Name: field.Name, Value: field.Value})
+	}
+	return condition, nil
+}
+
+// conditional returns the selector matching both document_selector and
+// condition, unless condition is nil.
+func conditional(document_selector, condition interface{}) interface{} {
+	if condition == nil {
+		return document_selector
+	}
+	return bson.M{"$and": []interface{}{document_selector, condition}}
+}
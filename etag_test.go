@@ -0,0 +1,90 @@
+package mongo
+
+import (
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type etagTestDocument struct {
+	Id     bson.ObjectId     `bson:"_id"`
+	Labels map[string]string `bson:"labels"`
+	Nested []bson.M          `bson:"nested"`
+}
+
+func TestETagStableWithMaps(t *testing.T) {
+	labels := map[string]string{}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		labels[key] = key
+	}
+	doc := &etagTestDocument{
+		Id:     bson.NewObjectId(),
+		Labels: labels,
+		Nested: []bson.M{{"x": 1, "y": 2, "z": 3}, {"w": 4, "v": 5}},
+	}
+
+	first, err := ETag(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		etag, err := ETag(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != first {
+			t.Fatalf("ETag changed from %s to %s for the same document", first, etag)
+		}
+	}
+
+	doc.Nested[0], doc.Nested[1] = doc.Nested[1], doc.Nested[0]
+	if etag, _ := ETag(doc); etag == first {
+		t.Errorf("ETag %s kept when the order of an array changed", etag)
+	}
+}
+
+func TestETagMarshalError(t *testing.T) {
+	if etag, err := ETag(bson.M{"f": func() {}}); err == nil {
+		t.Errorf("ETag %s returned for a document which can't be encoded", etag)
+	}
+}
+
+type etagTestVersioned struct {
+	Id       bson.ObjectId `bson:"_id"`
+	Name     string        `bson:"name"`
+	Revision int           `bson:"revision"`
+}
+
+func (doc *etagTestVersioned) ETag() string {
+	return strconv.Itoa(doc.Revision)
+}
+
+func (*etagTestVersioned) ETagField() string {
+	return "revision"
+}
+
+func TestETagCondition(t *testing.T) {
+	id := bson.NewObjectId()
+	data, err := bson.Marshal(&etagTestVersioned{Id: id, Name: "a", Revision: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := &bson.Raw{Kind: 0x03, Data: data}
+
+	condition, err := etagCondition(raw, &etagTestVersioned{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.D{{Name: "revision", Value: 7}}); !reflect.DeepEqual(condition, want) {
+		t.Errorf("condition %v, want %v", condition, want)
+	}
+
+	condition, err = etagCondition(raw, &etagTestDocument{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(condition) != 3 || condition[0].Name != "_id" || condition[1].Name != "name" || condition[2].Name != "revision" {
+		t.Errorf("condition %v, want every stored field", condition)
+	}
+}
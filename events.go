@@ -0,0 +1,179 @@
+package mongo
+
+import (
+	"labix.org/v2/mgo/bson"
+	"log"
+	"sync"
+	"time"
+)
+
+// ChangeEvent describes a document written through a repository.
+//
+// Key is the primary key selector of the document when known, and the
+// selector of the write otherwise. Before and After hold the document as it
+// was before and after the write when the operation has them at hand: After
+// holds the inserted or saved document and the document (or update) passed
+// to Update and UpdateDocument, and Before the document passed to
+// DeleteDocument and, as long as a subscriber of the collection registered
+// with SubscribeWithBefore, the document updated or saved as stored right
+// before the write.
+type ChangeEvent struct {
+	Collection string
+	Key        interface{}
+	Operation  Operation
+	Before     interface{}
+	After      interface{}
+	Time       time.Time
+}
+
+// EventBus delivers the ChangeEvents published by the repositories to its
+// subscribers, synchronously and in subscription order.
+type EventBus struct {
+	mutex         sync.RWMutex
+	subscriptions []*subscription
+}
+
+type subscription struct {
+	collection string
+	handler    func(e *ChangeEvent)
+	before     bool
+}
+
+// Events is the bus the repositories publish their changes to once a write
+// succeeded.
+var Events = NewEventBus()
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe registers handler for the changes of the repository stored in
+// collection, or of every repository when collection is empty. The
+// returned function cancels the subscription.
+//
+// Handlers run on the goroutine of the write, so slow work should be
+// handed to a Dispatcher. A handler panicking is logged, and doesn't fail
+// the write, which is done by then:
+//
+//     mongo.Events.Subscribe("users", func(e *mongo.ChangeEvent) {
+//             if e.Operation == mongo.OperationInsert {
+//                     mongo.AsyncHooks.Dispatch("welcome", func() error {
+//                             return sendWelcome(e.After.(*User))
+//                     })
+//             }
+//     })
+//
+func (b *EventBus) Subscribe(collection string, handler func(e *ChangeEvent)) func() {
+	return b.subscribe(&subscription{collection: collection, handler: handler})
+}
+
+// SubscribeWithBefore registers handler as Subscribe does, the updates and
+// saves of the collection setting the Before of their events. It costs a
+// read of the document ahead of every such write.
+func (b *EventBus) SubscribeWithBefore(collection string, handler func(e *ChangeEvent)) func() {
+	return b.subscribe(&subscription{collection: collection, handler: handler, before: true})
+}
+
+func (b *EventBus) subscribe(s *subscription) func() {
+	b.mutex.Lock()
+	b.subscriptions = append(b.subscriptions, s)
+	b.mutex.Unlock()
+
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		for i, subscribed := range b.subscriptions {
+			if subscribed == s {
+				b.subscriptions = append(b.subscriptions[:i:i], b.subscriptions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Publish delivers e to the subscribers of its collection.
+func (b *EventBus) Publish(e *ChangeEvent) {
+	b.mutex.RLock()
+	subscriptions := b.subscriptions
+	b.mutex.RUnlock()
+
+	for _, s := range subscriptions {
+		if s.collection == "" || s.collection == e.Collection {
+			s.deliver(e)
+		}
+	}
+}
+
+// deliver runs the handler of s on e, logging its panic.
+func (s *subscription) deliver(e *ChangeEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("mongo: the subscriber of the %s changes panicked: %v", e.Collection, r)
+		}
+	}()
+	s.handler(e)
+}
+
+// wantsBefore reports whether the changes of collection have subscribers
+// registered with SubscribeWithBefore.
+func (b *EventBus) wantsBefore(collection string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, s := range b.subscriptions {
+		if s.before && (s.collection == "" || s.collection == collection) {
+			return true
+		}
+	}
+	return false
+}
+
+// changeEvent returns the ChangeEvent of a successful write, or nil when e
+// doesn't describe a write.
+func changeEvent(e *HookEvent) *ChangeEvent {
+	change := &ChangeEvent{
+		Collection: e.Collection,
+		Operation:  e.Operation,
+		Key:        e.Selector,
+		Time:       time.Now(),
+	}
+
+	switch e.Operation {
+	case OperationInsert:
+		change.After = e.Document
+	case OperationUpdate:
+		change.Before, change.After = e.before, e.Document
+	case OperationSave:
+		change.Before, change.After = e.before, e.Document
+		change.Operation = OperationUpdate
+		if e.ChangeInfo != nil && e.ChangeInfo.UpsertedId != nil {
+			change.Operation = OperationInsert
+		}
+	case OperationDelete:
+		change.Before = e.Document
+	case OperationModify:
+		switch {
+		case e.ChangeInfo == nil:
+			return nil
+		case e.ChangeInfo.Removed > 0:
+			change.Operation = OperationDelete
+		case e.ChangeInfo.UpsertedId != nil:
+			change.Operation = OperationInsert
+			change.Key = bson.M{"_id": e.ChangeInfo.UpsertedId}
+		case e.ChangeInfo.Updated > 0:
+			change.Operation = OperationUpdate
+		default:
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if doc, is := e.Document.(DocumentWithPrimaryKey); is {
+		change.Key = doc.PrimaryKey(e.Context)
+	} else if change.Key == nil && e.Document != nil {
+		change.Key = bson.M{"_id": documentId(e.Document)}
+	}
+
+	return change
+}
@@ -0,0 +1,41 @@
+package mongo
+
+import (
+	"testing"
+)
+
+func TestEventBusPublishRecovers(t *testing.T) {
+	bus := NewEventBus()
+
+	delivered := false
+	bus.Subscribe("users", func(e *ChangeEvent) {
+		panic("subscriber failed")
+	})
+	bus.Subscribe("", func(e *ChangeEvent) {
+		delivered = true
+	})
+
+	bus.Publish(&ChangeEvent{Collection: "users", Operation: OperationInsert})
+	if !delivered {
+		t.Fatal("the subscribers after a panicking one missed the change")
+	}
+}
+
+func TestEventBusWantsBefore(t *testing.T) {
+	bus := NewEventBus()
+
+	bus.Subscribe("", func(e *ChangeEvent) {})
+	if bus.wantsBefore("users") {
+		t.Fatal("a subscriber which didn't ask for Before costs a read")
+	}
+
+	cancel := bus.SubscribeWithBefore("users", func(e *ChangeEvent) {})
+	if !bus.wantsBefore("users") || bus.wantsBefore("posts") {
+		t.Fatal("Before isn't read for the collection of the subscriber only")
+	}
+
+	cancel()
+	if bus.wantsBefore("users") {
+		t.Fatal("Before is still read once the subscription is cancelled")
+	}
+}
@@ -0,0 +1,501 @@
+package mongo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventStream streams the changes of a repository to browsers as
+// Server-Sent Events, one per changed document:
+//
+//     event: update
+//     id: 5a1f...-12
+//     data: {"operation":"update","key":{"_id":"5a1f..."},"document":{...},"time":"..."}
+//
+// It subscribes to Bus, the Events of the process by default. Changes made
+// by other processes are streamed by feeding a bus from a ChangeFeed:
+//
+//     bus := mongo.NewEventBus()
+//     go mongo.NewChangeFeed(mongo.MongoSession, "dashboard", func(e *mongo.ChangeEvent) error {
+//             bus.Publish(e)
+//             return nil
+//     }).Run(ctx)
+//
+//     stream := mongo.NewEventStream(Orders)
+//     stream.Bus = bus
+//     http.Handle("/orders/events", stream)
+//
+// The documents are read again through the repository, on behalf of the
+// request of the stream: a change is streamed only when its document is
+// still selected once the search hooks rewrote the selector, so the row
+// filters of HookRewriteSearch apply, and the document sent is the one
+// loaded through the load hooks. A document streamed before and no longer
+// selected after an update is sent as a "leave" event carrying its key. As
+// deleted documents can't be read anymore, the deletes carry the key only,
+// and are sent only for the documents already streamed to the request when
+// Deletes is set, so that a stream never learns the keys its filters hide.
+//
+// The last History changes are kept, so that a browser reconnecting with
+// the Last-Event-ID of the last event it got receives the changes it
+// missed. When they're no longer kept, or the process restarted, a "reset"
+// event tells it to reload the documents. A stream which falls behind by
+// more than Buffer changes is closed, so that the browser reconnects.
+//
+// The requests which don't accept text/event-stream are long polls: they
+// wait up to PollTimeout for changes after the id given by the last
+// parameter, and are answered with a JSON object holding the events, the
+// id to poll from next and the session to pass back, which records the
+// documents streamed as a connection does:
+//
+//     GET /orders/events?last=5a1f...-12&session=5a20...
+//
+//     {"session":"5a20...","id":"5a1f...-14","events":[{"operation":"insert",...}]}
+//
+type EventStream struct {
+	Repository func(interface{}) *repositoryOperator
+	Bus        *EventBus
+
+	// Filter drops the changes it returns false for, when not nil.
+	Filter func(r *http.Request, e *ChangeEvent) bool
+	// Deletes enables the streaming of the deletes of the documents
+	// streamed before.
+	Deletes bool
+	// Buffer is the number of changes waiting to be streamed, at least 1.
+	Buffer int
+	// History is the number of changes kept for the browsers reconnecting
+	// and the long polls.
+	History int
+	// Heartbeat is the interval at which a comment is sent to keep the
+	// connection open through the proxies, none when 0.
+	Heartbeat time.Duration
+	// Retry is the reconnection delay advised to the browsers.
+	Retry time.Duration
+	// PollTimeout is the time a long poll waits for changes.
+	PollTimeout time.Duration
+
+	start     sync.Once
+	mutex     sync.Mutex
+	epoch     string
+	seq       uint64
+	history   []*streamChange
+	listeners map[*streamListener]bool
+	polls     map[string]*streamPoll
+}
+
+func NewEventStream(repo func(interface{}) *repositoryOperator) *EventStream {
+	return &EventStream{
+		Repository:  repo,
+		Bus:         Events,
+		Deletes:     true,
+		Buffer:      64,
+		History:     256,
+		Heartbeat:   15 * time.Second,
+		Retry:       3 * time.Second,
+		PollTimeout: 25 * time.Second,
+	}
+}
+
+// streamEvent is the data of a Server-Sent Event.
+type streamEvent struct {
+	Operation Operation   `json:"operation"`
+	Key       interface{} `json:"key,omitempty"`
+	Document  interface{} `json:"document,omitempty"`
+	Time      time.Time   `json:"time"`
+}
+
+// streamLeave is the operation of the events of the documents no longer
+// selected after an update.
+const streamLeave Operation = "leave"
+
+// streamChange is a change numbered in the history of the stream.
+type streamChange struct {
+	seq    uint64
+	change *ChangeEvent
+}
+
+// streamListener receives the changes of the stream for a request.
+type streamListener struct {
+	changes  chan *streamChange
+	overflow chan struct{}
+	once     sync.Once
+}
+
+// streamPoll is the session of long polls, recording the keys streamed.
+type streamPoll struct {
+	mutex sync.Mutex
+	sent  map[string]bool
+	used  time.Time
+}
+
+// streamPollResponse is the answer of a long poll.
+type streamPollResponse struct {
+	Session string         `json:"session"`
+	Id      string         `json:"id"`
+	Reset   bool           `json:"reset,omitempty"`
+	Events  []*streamEvent `json:"events"`
+}
+
+func (s *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	operator := s.Repository(r)
+	s.subscribe(operator.repository.collection)
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		s.poll(w, r, operator)
+		return
+	}
+
+	flusher, is := w.(http.Flusher)
+	if !is {
+		writeError(w, errors.New("mongo: the response writer can't stream"))
+		return
+	}
+
+	backlog, reset, head, listener := s.listen(r.Header.Get("Last-Event-ID"))
+	defer s.unlisten(listener)
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", s.Retry/time.Millisecond)
+	if reset {
+		fmt.Fprintf(w, "event: reset\nid: %s\ndata: {}\n\n", head)
+	}
+
+	// The keys streamed, whose deletes may be sent.
+	sent := map[string]bool{}
+
+	write := func(change *streamChange) bool {
+		events, err := s.events(r, operator, change.change, sent)
+		if err != nil {
+			return false
+		}
+
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return false
+			}
+			fmt.Fprintf(w, "event: %s\nid: %s\ndata: %s\n\n", event.Operation, s.eventId(change.seq), data)
+		}
+		return true
+	}
+
+	for _, change := range backlog {
+		if !write(change) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	var heartbeat <-chan time.Time
+	if s.Heartbeat > 0 {
+		ticker := time.NewTicker(s.Heartbeat)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-operator.ctx.Done():
+			return
+		case <-listener.overflow:
+			return
+		case <-heartbeat:
+			fmt.Fprint(w, ": ping\n\n")
+		case change := <-listener.changes:
+			if !write(change) {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// poll answers the long poll r with the events following its last
+// parameter, waiting up to PollTimeout for some.
+func (s *EventStream) poll(w http.ResponseWriter, r *http.Request, operator *repositoryOperator) {
+	query := r.URL.Query()
+
+	session, state := s.pollSession(query.Get("session"))
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	backlog, reset, head, listener := s.listen(query.Get("last"))
+	defer s.unlisten(listener)
+
+	response := &streamPollResponse{Session: session, Id: query.Get("last"), Reset: reset, Events: []*streamEvent{}}
+	if reset || response.Id == "" {
+		response.Id = head
+	}
+
+	collect := func(change *streamChange) error {
+		events, err := s.events(r, operator, change.change, state.sent)
+		response.Events = append(response.Events, events...)
+		response.Id = s.eventId(change.seq)
+		return err
+	}
+
+	for _, change := range backlog {
+		if err := collect(change); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if len(response.Events) == 0 && !reset {
+		timeout := time.NewTimer(s.PollTimeout)
+		defer timeout.Stop()
+
+	wait:
+		for len(response.Events) == 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-operator.ctx.Done():
+				return
+			case <-listener.overflow:
+				break wait
+			case <-timeout.C:
+				break wait
+			case change := <-listener.changes:
+				if err := collect(change); err != nil {
+					writeError(w, err)
+					return
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	writeJSON(w, http.StatusOK, response)
+}
+
+// subscribe starts recording the changes of collection on the first
+// request of the stream.
+func (s *EventStream) subscribe(collection string) {
+	s.start.Do(func() {
+		s.epoch = bson.NewObjectId().Hex()
+		s.listeners = map[*streamListener]bool{}
+		s.polls = map[string]*streamPoll{}
+		s.Bus.Subscribe(collection, s.record)
+	})
+}
+
+// record numbers change, keeps it in the history and hands it to the
+// listeners. The bus delivers the changes on the goroutine of the writes,
+// which must not wait for the streams.
+func (s *EventStream) record(e *ChangeEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	change := &streamChange{seq: s.seq, change: e}
+
+	if s.History > 0 {
+		if len(s.history) >= s.History {
+			s.history = append(s.history[:0], s.history[len(s.history)-s.History+1:]...)
+		}
+		s.history = append(s.history, change)
+	}
+
+	for listener := range s.listeners {
+		select {
+		case listener.changes <- change:
+		default:
+			listener.once.Do(func() {
+				close(listener.overflow)
+			})
+		}
+	}
+}
+
+// listen registers a listener of the changes following the event id last,
+// returning the ones already kept, or reset when some of them aren't kept
+// anymore, along with the id of the last change recorded.
+func (s *EventStream) listen(last string) (backlog []*streamChange, reset bool, head string, listener *streamListener) {
+	buffer := s.Buffer
+	if buffer < 1 {
+		buffer = 1
+	}
+	listener = &streamListener{changes: make(chan *streamChange, buffer), overflow: make(chan struct{})}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.listeners[listener] = true
+	head = s.eventId(s.seq)
+
+	if last == "" {
+		return nil, false, head, listener
+	}
+
+	seq, ok := s.parseEventId(last)
+	switch {
+	case !ok || seq > s.seq:
+		return nil, true, head, listener
+	case seq == s.seq:
+		return nil, false, head, listener
+	case len(s.history) == 0 || s.history[0].seq > seq+1:
+		return nil, true, head, listener
+	}
+
+	for _, change := range s.history {
+		if change.seq > seq {
+			backlog = append(backlog, change)
+		}
+	}
+	return backlog, false, head, listener
+}
+
+func (s *EventStream) unlisten(listener *streamListener) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.listeners, listener)
+}
+
+// pollSession returns the long poll session id, or a new one when it's
+// unknown, dropping the sessions unused for a while.
+func (s *EventStream) pollSession(id string) (string, *streamPoll) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for key, state := range s.polls {
+		if now.Sub(state.used) > 2*s.PollTimeout+time.Minute {
+			delete(s.polls, key)
+		}
+	}
+
+	state, ok := s.polls[id]
+	if !ok {
+		id = bson.NewObjectId().Hex()
+		state = &streamPoll{sent: map[string]bool{}}
+		s.polls[id] = state
+	}
+	state.used = now
+	return id, state
+}
+
+// eventId returns the id of the event of the change numbered seq, prefixed
+// with the epoch of the stream so that the ids of another process aren't
+// taken for its own.
+func (s *EventStream) eventId(seq uint64) string {
+	return s.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+func (s *EventStream) parseEventId(id string) (uint64, bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || id[:i] != s.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return seq, err == nil
+}
+
+// events returns the events of change visible to the request r, recording
+// the keys of the documents streamed in sent.
+func (s *EventStream) events(r *http.Request, operator *repositoryOperator, change *ChangeEvent, sent map[string]bool) ([]*streamEvent, error) {
+	if s.Filter != nil && !s.Filter(r, change) {
+		return nil, nil
+	}
+
+	switch change.Operation {
+	case OperationDelete:
+		key := streamKey(change.Key)
+		if !s.Deletes || key == "" || !sent[key] {
+			return nil, nil
+		}
+		delete(sent, key)
+		return []*streamEvent{{Operation: change.Operation, Key: change.Key, Time: change.Time}}, nil
+	case OperationInsert, OperationUpdate:
+	default:
+		return nil, nil
+	}
+
+	// A change without key can't be told apart from a search of the whole
+	// collection.
+	if change.Key == nil {
+		return nil, nil
+	}
+
+	// The document streamed before and hidden by the update leaves the
+	// stream.
+	changed := streamKey(change.Key)
+	leave := changed != "" && sent[changed]
+
+	items, err := operator.Search(change.Key).GetAllE()
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		items, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*streamEvent
+	if items != nil {
+		slice := reflect.ValueOf(items)
+		for i := 0; i < slice.Len(); i++ {
+			document := slice.Index(i).Addr().Interface()
+
+			var key interface{}
+			if doc, is := document.(DocumentWithPrimaryKey); is {
+				key = doc.PrimaryKey(operator.context)
+			} else {
+				key = bson.M{"_id": documentId(document)}
+			}
+			if k := streamKey(key); k != "" {
+				sent[k] = true
+				if k == changed {
+					leave = false
+				}
+			}
+
+			events = append(events, &streamEvent{
+				Operation: change.Operation,
+				Key:       key,
+				Document:  document,
+				Time:      change.Time,
+			})
+		}
+	}
+
+	if leave {
+		delete(sent, changed)
+		events = append(events, &streamEvent{Operation: streamLeave, Key: change.Key, Time: change.Time})
+	}
+	return events, nil
+}
+
+// streamKey returns the identity of the document key, its BSON with the
+// fields sorted as maps don't keep their order, empty when it can't be
+// told.
+func streamKey(key interface{}) string {
+	data, err := bson.Marshal(key)
+	if err == nil {
+		data, err = sortedDocument(data, false)
+	}
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
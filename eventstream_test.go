@@ -0,0 +1,80 @@
+package mongo
+
+import (
+	"testing"
+)
+
+func TestEventStreamHistory(t *testing.T) {
+	bus := NewEventBus()
+	s := &EventStream{Bus: bus, Buffer: 8, History: 2}
+	s.subscribe("tests")
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			bus.Publish(&ChangeEvent{Collection: "tests", Operation: OperationInsert})
+		}
+	}
+
+	_, _, first, listener := s.listen("")
+	s.unlisten(listener)
+	publish(3)
+
+	tests := []struct {
+		name    string
+		last    string
+		backlog []uint64
+		reset   bool
+	}{
+		{"new connection", "", nil, false},
+		{"up to date", s.eventId(3), nil, false},
+		{"missed one", s.eventId(2), []uint64{3}, false},
+		{"missed the history", s.eventId(1), []uint64{2, 3}, false},
+		{"missed more than the history", first, nil, true},
+		{"another process", "5a1f0000000000000000000a-2", nil, true},
+		{"ahead of the stream", s.eventId(4), nil, true},
+		{"malformed", "12", nil, true},
+	}
+	for _, test := range tests {
+		backlog, reset, head, listener := s.listen(test.last)
+		s.unlisten(listener)
+
+		var seqs []uint64
+		for _, change := range backlog {
+			seqs = append(seqs, change.seq)
+		}
+		if reset != test.reset || len(seqs) != len(test.backlog) {
+			t.Errorf("%s: backlog %v and reset %v, want %v and %v", test.name, seqs, reset, test.backlog, test.reset)
+			continue
+		}
+		for i := range seqs {
+			if seqs[i] != test.backlog[i] {
+				t.Errorf("%s: backlog %v, want %v", test.name, seqs, test.backlog)
+				break
+			}
+		}
+		if head != s.eventId(3) {
+			t.Errorf("%s: head %s, want %s", test.name, head, s.eventId(3))
+		}
+	}
+}
+
+func TestEventStreamOverflow(t *testing.T) {
+	bus := NewEventBus()
+	s := &EventStream{Bus: bus, Buffer: 1}
+	s.subscribe("tests")
+
+	_, _, _, listener := s.listen("")
+	defer s.unlisten(listener)
+
+	bus.Publish(&ChangeEvent{Collection: "tests", Operation: OperationInsert})
+	bus.Publish(&ChangeEvent{Collection: "tests", Operation: OperationInsert})
+
+	select {
+	case <-listener.overflow:
+	default:
+		t.Fatal("a listener falling behind isn't closed")
+	}
+	if change := <-listener.changes; change.seq != 1 {
+		t.Fatalf("got the change %d, want 1", change.seq)
+	}
+}
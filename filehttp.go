@@ -0,0 +1,213 @@
+package mongo
+
+import (
+	"errors"
+	"github.com/go4r/handy"
+	"io"
+	"labix.org/v2/mgo/bson"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// ErrNoFile is returned when an upload request holds no file.
+var ErrNoFile = errors.New("mongo: the request holds no file")
+
+// FileHandler serves a file repository over HTTP:
+//
+//     POST   /prefix          uploads the files of the multipart body
+//     GET    /prefix/{id}     downloads the file
+//     DELETE /prefix/{id}     deletes the file
+//
+// The uploads are streamed to GridFS part by part, and answered with the
+// JSON encoding of the uploaded Files. The downloads are served with
+// http.ServeContent, so they honor Range requests with 206 Partial Content
+// responses, and carry the Content-Type, the Content-Length, an ETag made
+// of the md5 of the file and its upload date as Last-Modified, answering
+// the conditional requests accordingly. Since the content types are the
+// ones the clients uploaded, the downloads are sent as attachments with
+// X-Content-Type-Options: nosniff, so that browsers don't render them as
+// pages of the site:
+//
+//     files := mongo.NewFileHandler(Avatars)
+//     files.Meta = func(r *http.Request, part *multipart.Part) (interface{}, error) {
+//             return &AvatarMeta{Owner: CurrentUser(r).Id}, nil
+//     }
+//     files.Mount("/avatars")
+//
+// The operations go through the file repository and its hooks, on the
+// session of the request, and errors map to status codes as for Resource.
+type FileHandler struct {
+	Files func(interface{}) *fileOperator
+
+	// Field is the name of the multipart fields holding the files, "file"
+	// by default.
+	Field string
+	// MaxUploadSize bounds the size of the upload requests.
+	MaxUploadSize int64
+	// Meta returns the metadata of the file uploaded in part, none when
+	// nil.
+	Meta func(r *http.Request, part *multipart.Part) (interface{}, error)
+	// Disposition is the Content-Disposition of the downloads, along
+	// with the name of the file, "attachment" by default. "inline" lets
+	// browsers display the files, and should only be set when the content
+	// types are trusted. It's not sent when empty.
+	Disposition string
+}
+
+func NewFileHandler(files func(interface{}) *fileOperator) *FileHandler {
+	return &FileHandler{
+		Files:         files,
+		Field:         "file",
+		MaxUploadSize: 32 << 20,
+		Disposition:   "attachment",
+	}
+}
+
+// Mount registers the upload and file routes of the handler under prefix
+// on the handy server.
+func (h *FileHandler) Mount(prefix string) {
+	h.MountOn(handy.Server, prefix)
+}
+
+// MountOn registers the routes of the handler on router, see Router.
+func (h *FileHandler) MountOn(router Router, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	router.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeUpload(w, r)
+	})
+	router.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, prefix+"/")
+		if id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+			h.ServeFile(w, r, fileId(id))
+		case "DELETE":
+			if err := h.Files(r).Delete(fileId(id)); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// ServeUpload stores the files of the multipart request r, answering with
+// the list of the uploaded Files.
+func (h *FileHandler) ServeUpload(w http.ResponseWriter, r *http.Request) {
+	files := h.Files(r)
+
+	if h.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxUploadSize)
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, &requestError{err})
+		return
+	}
+
+	// A request failing on a part stores none of its files.
+	uploaded := []*File{}
+	fail := func(err error) {
+		for _, file := range uploaded {
+			if files.Delete(file.Id) != nil {
+				files.GridFS().RemoveId(file.Id)
+			}
+		}
+		writeError(w, err)
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(&requestError{err})
+			return
+		}
+
+		if part.FormName() != h.Field || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		var meta interface{}
+		if h.Meta != nil {
+			if meta, err = h.Meta(r, part); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		// The file is returned along with the error of HookAfterUpload,
+		// once stored, and is discarded with the others.
+		file, err := files.Upload(part.FileName(), part.Header.Get("Content-Type"), part, meta)
+		part.Close()
+		if file != nil {
+			uploaded = append(uploaded, file)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+	}
+
+	if len(uploaded) == 0 {
+		writeError(w, &requestError{ErrNoFile})
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, uploaded)
+}
+
+// ServeFile serves the content of the file with the given id.
+func (h *FileHandler) ServeFile(w http.ResponseWriter, r *http.Request, id interface{}) {
+	reader, err := h.Files(r).Open(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer reader.Close()
+
+	header := w.Header()
+	header.Set("X-Content-Type-Options", "nosniff")
+	if reader.ContentType != "" {
+		header.Set("Content-Type", reader.ContentType)
+	}
+	if reader.MD5 != "" {
+		header.Set("ETag", `"`+reader.MD5+`"`)
+	}
+	if h.Disposition != "" {
+		params := map[string]string{}
+		if reader.Name != "" {
+			params["filename"] = reader.Name
+		}
+		header.Set("Content-Disposition", mime.FormatMediaType(h.Disposition, params))
+	}
+
+	http.ServeContent(w, r, reader.Name, reader.UploadDate, reader)
+}
+
+// fileId returns the id of the file of the route id.
+func fileId(id string) interface{} {
+	if bson.IsObjectIdHex(id) {
+		return bson.ObjectIdHex(id)
+	}
+	return id
+}
@@ -0,0 +1,423 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"github.com/go4r/handy"
+	"io"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// File describes a file stored in GridFS. Meta holds its metadata, decoded
+// into the metadata type of the repository.
+type File struct {
+	Id          interface{} `json:"id"`
+	Name        string      `json:"name"`
+	ContentType string      `json:"contentType,omitempty"`
+	Length      int64       `json:"length"`
+	MD5         string      `json:"md5"`
+	UploadDate  time.Time   `json:"uploadDate"`
+	Meta        interface{} `json:"meta,omitempty"`
+}
+
+// fileDocument is a document of the files collection of a GridFS.
+type fileDocument struct {
+	Id          interface{} `bson:"_id"`
+	Filename    string      `bson:"filename"`
+	ContentType string      `bson:"contentType"`
+	Length      int64       `bson:"length"`
+	MD5         string      `bson:"md5"`
+	UploadDate  time.Time   `bson:"uploadDate"`
+	Metadata    *bson.Raw   `bson:"metadata"`
+}
+
+type fileRepository struct {
+	prefix   string
+	metaType reflect.Type
+	nilMeta  interface{}
+}
+
+// NewFileRepository returns the operators of the GridFS stored under
+// prefix in the database of the "mongo.db" provider, as NewRepository
+// does for documents:
+//
+//     var Avatars = mongo.NewFileRepository("avatars", &AvatarMeta{})
+//
+//     file, err := Avatars(r).Upload(header.Filename, header.Header.Get("Content-Type"), part, &AvatarMeta{Owner: id})
+//
+// The metadata of the files are decoded into the type nilMeta points to,
+// or into a bson.M when nilMeta is nil. HookOnUpload, HookAfterUpload,
+// HookOnOpen, HookOnDeleteFile and HookAfterDeleteFile run on the metadata
+// of the file, or on nilMeta when the file has none.
+func NewFileRepository(prefix string, nilMeta interface{}) func(interface{}) *fileOperator {
+	repo := &fileRepository{prefix: prefix, nilMeta: nilMeta}
+
+	if nilMeta != nil {
+		typ := reflect.TypeOf(nilMeta)
+		if typ.Kind() != reflect.Ptr {
+			panic(errors.New("Invalid Argument the second argument shoul'd to be a pointer"))
+		}
+		repo.metaType = typ.Elem()
+	}
+
+	return func(rc interface{}) *fileOperator {
+		return repo.Operator(rc)
+	}
+}
+
+func (self *fileRepository) Operator(rc interface{}) *fileOperator {
+	return self.operator(cContext(rc))
+}
+
+func (self *fileRepository) operator(c *handy.Context) *fileOperator {
+	files := c.GetFactory("mongo.files." + self.prefix)
+
+	if files != nil {
+		return files().(*fileOperator)
+	}
+
+	// Files are read and written over many round trips, so the GridFS is
+	// bound to the session of the request, as returned by CSession.
+	database := c.Get("mongo.db").(*mgo.Database)
+	gridfs := c.Get("mongo.session").(*mgo.Session).DB(database.Name).GridFS(self.prefix)
+	ctx := c.Get("mongo.context").(context.Context)
+	operator := &fileOperator{repository: self, context: c, gridfs: gridfs, ctx: ctx}
+	c.SetValue("mongo.files."+self.prefix, operator)
+	return operator
+}
+
+type fileOperator struct {
+	repository *fileRepository
+	context    *handy.Context
+	gridfs     *mgo.GridFS
+	ctx        context.Context
+}
+
+func (self *fileOperator) Context() *handy.Context {
+	return self.context
+}
+
+func (self *fileOperator) GridFS() *mgo.GridFS {
+	return self.gridfs
+}
+
+func (self *fileOperator) wrapError(err error) error {
+	return wrapError(self.ctx, err)
+}
+
+// hooked returns the value the hooks of a file with meta run on.
+func (self *fileOperator) hooked(meta interface{}) interface{} {
+	if meta != nil {
+		return meta
+	}
+	return self.repository.nilMeta
+}
+
+func (self *fileOperator) after(meta interface{}, hook string, run func(meta interface{}, c *handy.Context) error) error {
+	return dispatchAfter(self.repository.prefix, self.context, meta, hook, run)
+}
+
+// decodeMeta decodes the metadata of a file.
+func (self *fileOperator) decodeMeta(raw *bson.Raw) (interface{}, error) {
+	if self.repository.metaType == nil {
+		meta := bson.M{}
+		if raw != nil && len(raw.Data) > 0 {
+			if err := bson.Unmarshal(raw.Data, &meta); err != nil {
+				return nil, err
+			}
+		}
+		return meta, nil
+	}
+
+	meta := reflect.New(self.repository.metaType).Interface()
+	if raw != nil && len(raw.Data) > 0 {
+		if err := bson.Unmarshal(raw.Data, meta); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+func (self *fileOperator) describe(doc *fileDocument) (*File, error) {
+	meta, err := self.decodeMeta(doc.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		Id:          doc.Id,
+		Name:        doc.Filename,
+		ContentType: doc.ContentType,
+		Length:      doc.Length,
+		MD5:         doc.MD5,
+		UploadDate:  doc.UploadDate,
+		Meta:        meta,
+	}, nil
+}
+
+// Upload stores the content read from r as a new file, returning it once
+// fully written. The file is discarded when reading r fails, HookOnUpload
+// fails or the context is done. HookOnUpload may change the name, content
+// type and metadata of the file before it's written. The file is stored
+// when HookAfterUpload fails, and is returned along with its error.
+func (self *fileOperator) Upload(name, contentType string, r io.Reader, meta interface{}) (*File, error) {
+	if err := self.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file := &File{Name: name, ContentType: contentType, Meta: meta}
+
+	if hook, is := self.hooked(meta).(HookOnUpload); is {
+		if err := hook.HookOnUpload(self.context, file); err != nil {
+			return nil, hookError("HookOnUpload", err)
+		}
+	}
+
+	gridFile, err := self.gridfs.Create(file.Name)
+	if err != nil {
+		return nil, self.wrapError(err)
+	}
+	if file.ContentType != "" {
+		gridFile.SetContentType(file.ContentType)
+	}
+	if file.Meta != nil {
+		gridFile.SetMeta(file.Meta)
+	}
+
+	if _, err := io.Copy(gridFile, &contextReader{ctx: self.ctx, r: r}); err != nil {
+		gridFile.Abort()
+		gridFile.Close()
+		return nil, self.wrapError(err)
+	}
+	if err := gridFile.Close(); err != nil {
+		return nil, self.wrapError(err)
+	}
+
+	file.Id = gridFile.Id()
+	file.Length = gridFile.Size()
+	file.MD5 = gridFile.MD5()
+	file.UploadDate = gridFile.UploadDate()
+
+	if hook, is := self.hooked(file.Meta).(HookAfterUpload); is {
+		err := self.after(hook, "HookAfterUpload", func(hook interface{}, c *handy.Context) error {
+			return hook.(HookAfterUpload).HookAfterUpload(c, file)
+		})
+		if err != nil {
+			return file, err
+		}
+	}
+
+	return file, nil
+}
+
+// Stat returns the file with the given id, once HookOnOpen allowed it.
+func (self *fileOperator) Stat(id interface{}) (*File, error) {
+	file, err := self.stat(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.open(file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// open runs HookOnOpen on file.
+func (self *fileOperator) open(file *File) error {
+	if hook, is := self.hooked(file.Meta).(HookOnOpen); is {
+		if err := hook.HookOnOpen(self.context, file); err != nil {
+			return hookError("HookOnOpen", err)
+		}
+	}
+	return nil
+}
+
+// stat returns the file with the given id, without running the hooks.
+func (self *fileOperator) stat(id interface{}) (*File, error) {
+	if err := self.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	doc := &fileDocument{}
+	if err := self.gridfs.Files.FindId(id).One(doc); err != nil {
+		return nil, self.wrapError(err)
+	}
+	return self.describe(doc)
+}
+
+// Open opens the file with the given id for reading, once HookOnOpen
+// allowed it. The reader is seekable, so a range of the file is read by
+// seeking to its start:
+//
+//     reader, err := Avatars(r).Open(id)
+//     if err != nil {
+//             return err
+//     }
+//     defer reader.Close()
+//     reader.Seek(offset, io.SeekStart)
+//     io.CopyN(w, reader, length)
+//
+func (self *fileOperator) Open(id interface{}) (*FileReader, error) {
+	file, err := self.Stat(id)
+	if err != nil {
+		return nil, err
+	}
+
+	gridFile, err := self.gridfs.OpenId(id)
+	if err != nil {
+		return nil, self.wrapError(err)
+	}
+
+	return &FileReader{File: file, file: gridFile, ctx: self.ctx}, nil
+}
+
+// Download writes length bytes of the file with the given id, starting at
+// offset, to w. A negative length writes up to the end of the file.
+func (self *fileOperator) Download(id interface{}, w io.Writer, offset, length int64) (*File, error) {
+	reader, err := self.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if offset > 0 {
+		if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+
+	if length < 0 {
+		_, err = io.Copy(w, reader)
+	} else {
+		_, err = io.CopyN(w, reader, length)
+	}
+	return reader.File, err
+}
+
+// Delete removes the file with the given id along with its chunks.
+func (self *fileOperator) Delete(id interface{}) error {
+	file, err := self.stat(id)
+	if err != nil {
+		return err
+	}
+
+	if hook, is := self.hooked(file.Meta).(HookOnDeleteFile); is {
+		if err := hook.HookOnDeleteFile(self.context, file); err != nil {
+			return hookError("HookOnDeleteFile", err)
+		}
+	}
+
+	if err := self.gridfs.RemoveId(id); err != nil {
+		return self.wrapError(err)
+	}
+
+	if hook, is := self.hooked(file.Meta).(HookAfterDeleteFile); is {
+		return self.after(hook, "HookAfterDeleteFile", func(hook interface{}, c *handy.Context) error {
+			return hook.(HookAfterDeleteFile).HookAfterDeleteFile(c, file)
+		})
+	}
+
+	return nil
+}
+
+// List returns the files whose metadata match metadata, a selector on the
+// metadata fields, sorted by the fields given in the Sort syntax. The files
+// HookOnOpen denies are left out, while its other errors fail the listing,
+// see deniedError:
+//
+//     files, err := Avatars(r).List(bson.M{"owner": id}, "-uploadDate")
+//
+func (self *fileOperator) List(metadata bson.M, sort ...string) ([]*File, error) {
+	selector := bson.M{}
+	for key, value := range metadata {
+		if strings.HasPrefix(key, "$") {
+			return nil, errors.New("mongo: operators can't be used on the metadata fields as a whole")
+		}
+		selector["metadata."+key] = value
+	}
+
+	query := self.gridfs.Find(selector)
+	if len(sort) > 0 {
+		query.Sort(sort...)
+	}
+
+	iter := query.Iter()
+	files := []*File{}
+
+	doc := &fileDocument{}
+	for self.ctx.Err() == nil && iter.Next(doc) {
+		file, err := self.describe(doc)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if err := self.open(file); err == nil {
+			files = append(files, file)
+		} else if !deniedError(err) {
+			iter.Close()
+			return nil, err
+		}
+		doc = &fileDocument{}
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, self.wrapError(err)
+	}
+	if err := self.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// deniedError reports whether err, returned by HookOnOpen, denies the
+// access to the file rather than failing: unless it's a context error, it's
+// answered with 403 Forbidden or 404 Not Found by Resource, as the errors
+// the hooks return are unless they implement ErrorWithStatus or wrap
+// ErrValidation.
+func deniedError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	status := statusCode(err)
+	return status == http.StatusForbidden || status == http.StatusNotFound
+}
+
+// FileReader reads a file opened with Open. It must be closed.
+type FileReader struct {
+	*File
+	file *mgo.GridFile
+	ctx  context.Context
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.file.Read(p)
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	return r.file.Seek(offset, whence)
+}
+
+func (r *FileReader) Close() error {
+	return r.file.Close()
+}
+
+// contextReader fails the reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
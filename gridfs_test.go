@@ -0,0 +1,41 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+type gridfsTestStatus int
+
+func (e gridfsTestStatus) Error() string {
+	return http.StatusText(int(e))
+}
+
+func (e gridfsTestStatus) StatusCode() int {
+	return int(e)
+}
+
+func TestDeniedError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		denied bool
+	}{
+		{"plain", errors.New("not the owner"), true},
+		{"not found", ErrNotFound, true},
+		{"forbidden status", gridfsTestStatus(http.StatusForbidden), true},
+		{"server error status", gridfsTestStatus(http.StatusServiceUnavailable), false},
+		{"validation", fmt.Errorf("%w: no owner", ErrValidation), false},
+		{"cancelled", context.Canceled, false},
+		{"deadline", context.DeadlineExceeded, false},
+	}
+
+	for _, test := range tests {
+		if denied := deniedError(hookError("HookOnOpen", test.err)); denied != test.denied {
+			t.Errorf("%s: deniedError() = %v, want %v", test.name, denied, test.denied)
+		}
+	}
+}
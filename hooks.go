@@ -20,7 +20,29 @@ type HookAfterSearch interface {
 	HookAfterSearch(c *handy.Context, document_selector interface{}) error
 }
 
+// Hook Rewrite Search|Update|Delete, returning the selector to be used in
+// place of document_selector, e.g. to enforce tenant or visibility filters
+type HookRewriteSearch interface {
+	HookRewriteSearch(c *handy.Context, document_selector interface{}) (interface{}, error)
+}
+
+type HookRewriteUpdate interface {
+	HookRewriteUpdate(c *handy.Context, document_selector interface{}) (interface{}, error)
+}
+
+type HookRewriteDelete interface {
+	HookRewriteDelete(c *handy.Context, document_selector interface{}) (interface{}, error)
+}
+
 // Hook On|After Loading
+//
+// Every read decoding documents (LoadDocument, One, All, GetOne, GetAll,
+// Paginate, Page, Aggregate and Populate) runs HookOnLoad on the document
+// and HookAfterLoad right after decoding it. LoadDocument, One and GetOne
+// run HookOnLoad on the document they read into before the query, as they
+// always did, and the other reads right before decoding each document. An
+// error returned by either aborts the read with a HookError, leaving the
+// result untouched, unless the query runs with CollectHookErrors.
 
 type HookOnLoad interface {
 	HookOnLoad(c *handy.Context) error
@@ -64,3 +86,34 @@ type HookOnSave interface {
 type HookAfterSave interface {
 	HookAfterSave(c *handy.Context, changeInfo *mgo.ChangeInfo) error
 }
+
+// Hook On|After Modify, run around query.Apply (findAndModify)
+type HookOnModify interface {
+	HookOnModify(c *handy.Context, document_selector interface{}, change *mgo.Change) error
+}
+
+type HookAfterModify interface {
+	HookAfterModify(c *handy.Context, document_selector interface{}, changeInfo *mgo.ChangeInfo) error
+}
+
+// Hook On|After Upload, On Open and On|After Delete of GridFS files, run
+// on their metadata, see NewFileRepository
+type HookOnUpload interface {
+	HookOnUpload(c *handy.Context, file *File) error
+}
+
+type HookAfterUpload interface {
+	HookAfterUpload(c *handy.Context, file *File) error
+}
+
+type HookOnOpen interface {
+	HookOnOpen(c *handy.Context, file *File) error
+}
+
+type HookOnDeleteFile interface {
+	HookOnDeleteFile(c *handy.Context, file *File) error
+}
+
+type HookAfterDeleteFile interface {
+	HookAfterDeleteFile(c *handy.Context, file *File) error
+}
@@ -3,8 +3,10 @@ package mongo
 import (
 	"github.com/go4r/handy"
 
+	"context"
 	"errors"
 	"labix.org/v2/mgo"
+	"net/http"
 )
 
 var (
@@ -50,17 +52,57 @@ var (
 			return func() interface{} {
 				return MongoDatabase
 			}
+		}).SetProvider(
+		"mongo.context", func(c *handy.Context) func() interface{} {
+			// The context is derived from the one of the request, once
+			// known, so the operations stop when the client goes away or
+			// the request deadline passes.
+			ctx := newRequestContext()
+			if request := c.GetFactory("mongo.request"); request != nil {
+				ctx.bind(request().(*http.Request).Context())
+			}
+
+			c.CleanupFunc(func() {
+				ctx.cancel(context.Canceled)
+			})
+
+			return func() interface{} {
+				return ctx
+			}
 		})
 )
 
+// cContext returns the handy context of r. When r is the *http.Request,
+// it's recorded and its context bound to the one of the operations, which
+// may already be in use if the handy.Context was passed first.
+func cContext(r interface{}) *handy.Context {
+	c := handy.CContext(r)
+	if request, is := r.(*http.Request); is && c.GetFactory("mongo.request") == nil {
+		c.SetValue("mongo.request", request)
+		if ctx, is := c.Get("mongo.context").(*requestContext); is {
+			ctx.bind(request.Context())
+		}
+	}
+	return c
+}
+
 func CSession(r interface{}) (*mgo.Session) {
-	return handy.CContext(r).Get("mongo.session").(*mgo.Session)
+	return cContext(r).Get("mongo.session").(*mgo.Session)
+}
+
+// CStdContext returns the context.Context of the request, which is
+// cancelled once the request is done. Once any function of the package is
+// passed the *http.Request, before or after the handy.Context, it's bound
+// to its context, so it's cancelled as well when the client goes away, and
+// carries its deadline.
+func CStdContext(r interface{}) context.Context {
+	return cContext(r).Get("mongo.context").(context.Context)
 }
 
 func CDB(r interface{}, name string) *mgo.Database {
-	return handy.CContext(r).Get("mongo.session").(*mgo.Session).DB(name)
+	return cContext(r).Get("mongo.session").(*mgo.Session).DB(name)
 }
 
 func CCollection(r interface{}, name string) *mgo.Collection {
-	return handy.CContext(r).Get("mongo.db").(*mgo.Database).C(name)
+	return cContext(r).Get("mongo.db").(*mgo.Database).C(name)
 }
@@ -0,0 +1,227 @@
+package mongo
+
+import (
+	"errors"
+	"github.com/go4r/handy"
+	"labix.org/v2/mgo"
+	"reflect"
+	"sync"
+)
+
+// Operation names the kind of repository operation a HookEvent describes.
+type Operation string
+
+const (
+	OperationSearch Operation = "search"
+	OperationLoad   Operation = "load"
+	OperationInsert Operation = "insert"
+	OperationUpdate Operation = "update"
+	OperationSave   Operation = "save"
+	OperationDelete Operation = "delete"
+	OperationModify Operation = "modify"
+)
+
+// HookEvent describes a repository operation to the middlewares.
+//
+// Document is the document being written, or the result being read into
+// when there's one. ChangeInfo is set once a save or modify operation is
+// done, and Err holds the outcome of the operation in the After functions.
+type HookEvent struct {
+	Operation  Operation
+	Collection string
+	Context    *handy.Context
+	Selector   interface{}
+	Document   interface{}
+	ChangeInfo *mgo.ChangeInfo
+	Err        error
+
+	// written is set once the write of the operation succeeded, whatever
+	// the outcome of the after hooks, and before holds the document as it
+	// was before an update.
+	written bool
+	before  interface{}
+}
+
+// Middleware holds hooks running around the operations of every document
+// type, independently of the hook interfaces the type implements.
+//
+// Before runs ahead of the operation and its document hooks. Returning an
+// error aborts the operation with a HookError, while returning ErrSkip
+// short-circuits it successfully. After runs once the operation is done,
+// even when it failed, and its error is returned when the operation
+// itself succeeded.
+type Middleware struct {
+	Name   string
+	Before func(e *HookEvent) error
+	After  func(e *HookEvent) error
+}
+
+// ErrSkip is returned by a Before function to skip the operation without
+// failing it.
+var ErrSkip = errors.New("mongo: operation skipped by middleware")
+
+var (
+	middlewaresMutex      sync.RWMutex
+	globalMiddlewares     []Middleware
+	repositoryMiddlewares = map[string][]Middleware{}
+)
+
+// Use registers a middleware running around the operations of every
+// repository.
+//
+// The Before functions of the global middlewares run in registration order,
+// followed by the ones registered for the repository with UseFor; the After
+// functions run in the reverse order, and only for the middlewares whose
+// Before did run.
+//
+// The operations run outside of any request, those of the operators of
+// Queue.SessionOperator and the Workers and the query of the oplog of the
+// ChangeFeeds, go through the global middlewares too, with a nil Context,
+// which the middlewares reading it must check:
+//
+//     mongo.Use(mongo.Middleware{
+//             Name: "audit",
+//             After: func(e *mongo.HookEvent) error {
+//                     log.Printf("%s %s %v: %v", e.Operation, e.Collection, e.Selector, e.Err)
+//                     return nil
+//             },
+//     })
+//
+func Use(m Middleware) {
+	middlewaresMutex.Lock()
+	defer middlewaresMutex.Unlock()
+	globalMiddlewares = append(globalMiddlewares, m)
+}
+
+// UseFor registers a middleware running around the operations of the
+// repository stored in collection.
+func UseFor(collection string, m Middleware) {
+	middlewaresMutex.Lock()
+	defer middlewaresMutex.Unlock()
+	repositoryMiddlewares[collection] = append(repositoryMiddlewares[collection], m)
+}
+
+func middlewaresFor(collection string) []Middleware {
+	middlewaresMutex.RLock()
+	defer middlewaresMutex.RUnlock()
+
+	global, local := globalMiddlewares, repositoryMiddlewares[collection]
+	middlewares := make([]Middleware, 0, len(global)+len(local))
+	middlewares = append(middlewares, global...)
+	return append(middlewares, local...)
+}
+
+func (m Middleware) hookName() string {
+	if m.Name != "" {
+		return "Middleware " + m.Name
+	}
+	return "Middleware"
+}
+
+// perform executes operation, recording the write in the outbox when the
+// repository has one.
+func (self *repositoryOperator) perform(e *HookEvent, operation func() error) error {
+	if !isWrite(e.Operation) || !outboxEnabled(e.Collection) {
+		return operation()
+	}
+
+	settle, err := self.recordOutbox(e)
+	if err != nil {
+		return err
+	}
+
+	err = operation()
+
+	// The entry is kept when only the after hooks failed.
+	writeErr := err
+	if e.written {
+		writeErr = nil
+	}
+	if settleErr := self.wrapError(settle(writeErr)); err == nil {
+		err = settleErr
+	}
+
+	return err
+}
+
+// run executes operation between the middlewares of the repository.
+func (self *repositoryOperator) run(e *HookEvent, operation func() error) error {
+	if err := self.ctx.Err(); err != nil {
+		return err
+	}
+
+	e.Collection = self.repository.collection
+	e.Context = self.context
+
+	middlewares := middlewaresFor(self.repository.collection)
+
+	ran, err := runBefore(middlewares, e)
+	skipped := err == ErrSkip
+
+	switch {
+	case skipped:
+		err = nil
+	case err == nil:
+		err = self.perform(e, operation)
+	}
+
+	err = runAfter(middlewares, ran, e, err)
+
+	if e.written {
+		if change := changeEvent(e); change != nil {
+			Events.Publish(change)
+		}
+	}
+
+	return err
+}
+
+// snapshot records in e the document matching selector, which an update
+// or save is about to change, for the subscribers asking for the documents
+// before the changes, see SubscribeWithBefore. It's read as stored,
+// without the load hooks, once the selector was rewritten.
+func (self *repositoryOperator) snapshot(e *HookEvent, selector interface{}) {
+	if selector == nil || !Events.wantsBefore(e.Collection) {
+		return
+	}
+
+	before := reflect.New(self.repository.typE).Interface()
+	if self.collection.Find(selector).One(before) == nil {
+		e.before = before
+	}
+}
+
+// runBefore runs the Before functions of middlewares, returning how many
+// of them ran and ErrSkip or the HookError aborting the operation.
+func runBefore(middlewares []Middleware, e *HookEvent) (int, error) {
+	ran := 0
+	for _, m := range middlewares {
+		if m.Before != nil {
+			if err := m.Before(e); err == ErrSkip {
+				return ran, err
+			} else if err != nil {
+				return ran, hookError(m.hookName(), err)
+			}
+		}
+		ran++
+	}
+	return ran, nil
+}
+
+// runAfter runs the After functions of the middlewares whose Before ran,
+// given the outcome err of the operation, and returns the outcome.
+func runAfter(middlewares []Middleware, ran int, e *HookEvent, err error) error {
+	e.Err = err
+
+	for i := ran - 1; i >= 0; i-- {
+		if middlewares[i].After == nil {
+			continue
+		}
+		if afterErr := middlewares[i].After(e); afterErr != nil && err == nil {
+			err = hookError(middlewares[i].hookName(), afterErr)
+			e.Err = err
+		}
+	}
+
+	return err
+}
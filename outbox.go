@@ -0,0 +1,267 @@
+package mongo
+
+import (
+	"context"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"sync"
+	"time"
+)
+
+// OutboxCollection is the collection holding the changes waiting to be
+// delivered by an OutboxRelay.
+var OutboxCollection = "mongo.outbox"
+
+const (
+	outboxPending = "pending"
+	outboxReady   = "ready"
+)
+
+// OutboxEntry is a change recorded in the outbox. Id is unique per change
+// and stays the same across delivery attempts, so sinks can use it to drop
+// duplicates.
+type OutboxEntry struct {
+	Id          bson.ObjectId `bson:"_id"`
+	Collection  string        `bson:"collection"`
+	Key         interface{}   `bson:"key,omitempty"`
+	Operation   Operation     `bson:"operation"`
+	Document    bson.Raw      `bson:"document,omitempty"`
+	State       string        `bson:"state"`
+	Created     time.Time     `bson:"created"`
+	Attempts    int           `bson:"attempts"`
+	LockedUntil time.Time     `bson:"lockedUntil"`
+	LastError   string        `bson:"lastError,omitempty"`
+}
+
+var (
+	outboxMutex       sync.RWMutex
+	outboxCollections = map[string]bool{}
+)
+
+// EnableOutbox makes the writes of the repository stored in collection
+// record an OutboxEntry along with the document.
+//
+// The entry is written as pending before the document and made ready once
+// the write succeeded, or removed when it failed. Should the process die in
+// between, the relay delivers the pending entry after PendingTimeout, so
+// that no change is lost at the cost of a possible delivery for a write
+// that didn't happen.
+//
+// The modifications made with Apply are recorded as well. Their entry is
+// pending as OperationModify, and takes the operation the ChangeInfo tells
+// once done, as the ChangeEvents do, or is removed when no document was
+// modified.
+func EnableOutbox(collection string) {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	outboxCollections[collection] = true
+}
+
+func outboxEnabled(collection string) bool {
+	outboxMutex.RLock()
+	defer outboxMutex.RUnlock()
+	return outboxCollections[collection]
+}
+
+func isWrite(operation Operation) bool {
+	switch operation {
+	case OperationInsert, OperationUpdate, OperationSave, OperationDelete, OperationModify:
+		return true
+	}
+	return false
+}
+
+// outboxEntry returns the entry recording the write described by e.
+func outboxEntry(e *HookEvent) (*OutboxEntry, error) {
+	entry := &OutboxEntry{
+		Id:         bson.NewObjectId(),
+		Collection: e.Collection,
+		Operation:  e.Operation,
+		Key:        e.Selector,
+		Created:    time.Now(),
+	}
+
+	if change := changeEvent(e); change != nil {
+		entry.Operation = change.Operation
+		entry.Key = change.Key
+
+		document := change.After
+		if document == nil {
+			document = change.Before
+		}
+		if document != nil {
+			data, err := bson.Marshal(document)
+			if err != nil {
+				return nil, err
+			}
+			entry.Document = bson.Raw{Kind: 0x03, Data: data}
+		}
+	}
+
+	return entry, nil
+}
+
+// outbox returns the outbox collection next to the repository collection.
+func (self *repositoryOperator) outbox() *mgo.Collection {
+	return self.collection.Database.C(OutboxCollection)
+}
+
+// recordOutbox writes the pending entry of the write described by e, and
+// returns the function settling it once the write is done.
+func (self *repositoryOperator) recordOutbox(e *HookEvent) (func(err error) error, error) {
+	entry, err := outboxEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	entry.State = outboxPending
+
+	if err := self.wrapError(self.outbox().Insert(entry)); err != nil {
+		return nil, err
+	}
+
+	return func(err error) error {
+		if err != nil || changeEvent(e) == nil {
+			return self.outbox().RemoveId(entry.Id)
+		}
+
+		settled, err := outboxEntry(e)
+		if err != nil {
+			return err
+		}
+
+		set := bson.M{
+			"state":     outboxReady,
+			"operation": settled.Operation,
+			"key":       settled.Key,
+		}
+		if len(settled.Document.Data) > 0 {
+			set["document"] = settled.Document
+		}
+
+		return self.outbox().UpdateId(entry.Id, bson.M{"$set": set})
+	}, nil
+}
+
+// OutboxSink receives the entries delivered by an OutboxRelay. An entry is
+// removed from the outbox once Deliver returns nil, and retried otherwise.
+type OutboxSink interface {
+	Deliver(entry *OutboxEntry) error
+}
+
+type OutboxSinkFunc func(entry *OutboxEntry) error
+
+func (f OutboxSinkFunc) Deliver(entry *OutboxEntry) error {
+	return f(entry)
+}
+
+// OutboxRelay delivers the outbox entries to a sink, oldest first, with
+// at-least-once semantics: an entry whose delivery failed, or whose relay
+// died while delivering it, is delivered again once its lease expired.
+type OutboxRelay struct {
+	Session  *mgo.Session
+	Database string
+	Sink     OutboxSink
+
+	// Interval is the pause between two polls of an empty outbox.
+	Interval time.Duration
+	// Lease is the time an entry is reserved for a delivery attempt.
+	Lease time.Duration
+	// PendingTimeout is the age after which a pending entry, whose write
+	// was never settled, is delivered.
+	PendingTimeout time.Duration
+
+	// OnError receives the errors of the polls, which are retried after
+	// Interval. They are logged when it's nil.
+	OnError func(err error)
+}
+
+func NewOutboxRelay(session *mgo.Session, sink OutboxSink) *OutboxRelay {
+	return &OutboxRelay{
+		Session:        session,
+		Database:       MongoDBName,
+		Sink:           sink,
+		Interval:       time.Second,
+		Lease:          time.Minute,
+		PendingTimeout: 5 * time.Minute,
+	}
+}
+
+// Run delivers the entries until ctx is done, returning its error. The
+// polls failing are reported to OnError and retried after Interval.
+func (r *OutboxRelay) Run(ctx context.Context) error {
+	for {
+		delivered, err := r.RelayOnce(ctx)
+		if err != nil && err != ctx.Err() {
+			r.reportError(err)
+		}
+
+		if delivered == 0 || err != nil {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(r.Interval):
+			}
+		}
+	}
+}
+
+func (r *OutboxRelay) reportError(err error) {
+	if r.OnError != nil {
+		r.OnError(err)
+		return
+	}
+	log.Printf("mongo: outbox relay failed: %v", err)
+}
+
+// RelayOnce delivers the entries available, returning how many were
+// delivered.
+func (r *OutboxRelay) RelayOnce(ctx context.Context) (int, error) {
+	session := r.Session.Copy()
+	defer session.Close()
+	outbox := session.DB(r.Database).C(OutboxCollection)
+
+	delivered := 0
+	for ctx.Err() == nil {
+		now := time.Now()
+		selector := bson.M{
+			"lockedUntil": bson.M{"$lt": now},
+			"$or": []bson.M{
+				{"state": outboxReady},
+				{"state": outboxPending, "created": bson.M{"$lt": now.Add(-r.PendingTimeout)}},
+			},
+		}
+		change := mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{"lockedUntil": now.Add(r.Lease)},
+				"$inc": bson.M{"attempts": 1},
+			},
+			ReturnNew: true,
+		}
+
+		entry := &OutboxEntry{}
+		_, err := outbox.Find(selector).Sort("created").Apply(change, entry)
+		if err == mgo.ErrNotFound {
+			return delivered, nil
+		}
+		if err != nil {
+			return delivered, err
+		}
+
+		if err := r.Sink.Deliver(entry); err != nil {
+			// The entry is retried once its lease expired either way.
+			update := bson.M{"$set": bson.M{"lastError": err.Error()}}
+			if err := outbox.UpdateId(entry.Id, update); err != nil && err != mgo.ErrNotFound {
+				return delivered, err
+			}
+			continue
+		}
+
+		if err := outbox.RemoveId(entry.Id); err != nil && err != mgo.ErrNotFound {
+			return delivered, err
+		}
+		delivered++
+	}
+
+	return delivered, ctx.Err()
+}
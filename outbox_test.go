@@ -0,0 +1,39 @@
+package mongo
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+)
+
+func TestOutboxEntryModify(t *testing.T) {
+	id := bson.NewObjectId()
+	selector := bson.M{"name": "a"}
+
+	tests := []struct {
+		name      string
+		info      *mgo.ChangeInfo
+		operation Operation
+		key       interface{}
+	}{
+		{"pending", nil, OperationModify, selector},
+		{"update", &mgo.ChangeInfo{Updated: 1}, OperationUpdate, selector},
+		{"upsert", &mgo.ChangeInfo{UpsertedId: id}, OperationInsert, bson.M{"_id": id}},
+		{"remove", &mgo.ChangeInfo{Removed: 1}, OperationDelete, selector},
+	}
+	for _, test := range tests {
+		e := &HookEvent{Operation: OperationModify, Collection: "tests", Selector: selector, ChangeInfo: test.info}
+		entry, err := outboxEntry(e)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if entry.Operation != test.operation || !reflect.DeepEqual(entry.Key, test.key) {
+			t.Errorf("%s: recorded %s on %v, want %s on %v", test.name, entry.Operation, entry.Key, test.operation, test.key)
+		}
+	}
+
+	if !isWrite(OperationModify) {
+		t.Error("the modifications aren't recorded in the outbox")
+	}
+}
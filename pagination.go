@@ -0,0 +1,448 @@
+package mongo
+
+import (
+	"encoding/base64"
+	"errors"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCursor = errors.New("mongo: invalid pagination cursor")
+	ErrCursorFields  = errors.New("mongo: the selected fields must keep the sort key and _id")
+	ErrCursorValue   = errors.New("mongo: the sort key must hold null, numbers, strings, ObjectIds, booleans or dates")
+)
+
+// CursorPage is one page of a keyset pagination. Items holds a slice of the
+// repository type, Next and Previous are the opaque tokens to be handed back
+// to Paginate in order to move forward or backward from this page.
+type CursorPage struct {
+	Items       interface{} `json:"items"`
+	Next        string      `json:"next,omitempty"`
+	Previous    string      `json:"previous,omitempty"`
+	HasNext     bool        `json:"hasNext"`
+	HasPrevious bool        `json:"hasPrevious"`
+}
+
+type cursorToken struct {
+	Key   string      `bson:"k"`
+	Value interface{} `bson:"v"`
+	Id    interface{} `bson:"i"`
+	Back  bool        `bson:"b,omitempty"`
+}
+
+func (self *cursorToken) encode() (string, error) {
+	data, err := bson.Marshal(self)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursorToken decodes token, which the client may have forged: its
+// values are only accepted when they're scalars, so that they can't act as
+// operators in the selectors.
+func decodeCursorToken(token string) (*cursorToken, error) {
+	data, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &cursorToken{}
+	if bson.Unmarshal(data, cursor) != nil {
+		return nil, ErrInvalidCursor
+	}
+	if _, ok := sortRank(cursor.Value); !ok {
+		return nil, ErrInvalidCursor
+	}
+	// The id is only compared, as a value.
+	if cursor.Id == nil {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// sortTypes lists the BSON type numbers in the order MongoDB sorts the
+// values of different types, the types sorting together being grouped.
+// The null group holds the missing fields as well.
+var sortTypes = [][]int{
+	{-1},            // MinKey
+	{10},            // null
+	{1, 16, 18, 19}, // numbers
+	{2, 14},         // strings and symbols
+	{3},             // documents
+	{4},             // arrays
+	{5},             // binary data
+	{7},             // ObjectId
+	{8},             // booleans
+	{9},             // dates
+	{17},            // timestamps
+	{11},            // regular expressions
+	{127},           // MaxKey
+}
+
+// sortRank returns the group of sortTypes of the scalar value, and false
+// for the values which can't be cursor positions.
+func sortRank(value interface{}) (int, bool) {
+	switch value.(type) {
+	case nil:
+		return 1, true
+	case int, int32, int64, float64:
+		return 2, true
+	case string:
+		return 3, true
+	case bson.ObjectId:
+		return 7, true
+	case bool:
+		return 8, true
+	case time.Time:
+		return 9, true
+	}
+	return 0, false
+}
+
+// cursorBound returns the selector of the documents following the
+// position value, id in the order of field, walking it forward with the
+// operator $gt or backward with $lt. As the comparisons only match the
+// values of the same type, the values of the types sorting after (or
+// before) the one of value are selected by their type.
+func cursorBound(field string, value, id interface{}, operator string) (bson.M, error) {
+	if field == "_id" {
+		return bson.M{"_id": bson.M{operator: id}}, nil
+	}
+
+	rank, ok := sortRank(value)
+	if !ok {
+		return nil, ErrCursorValue
+	}
+
+	var or []bson.M
+	if value != nil {
+		or = append(or, bson.M{field: bson.M{operator: value}})
+	}
+	or = append(or, bson.M{field: value, "_id": bson.M{operator: id}})
+
+	for group, types := range sortTypes {
+		if operator == "$gt" && group <= rank || operator == "$lt" && group >= rank {
+			continue
+		}
+		if group == 1 {
+			or = append(or, bson.M{field: nil})
+			continue
+		}
+		for _, typ := range types {
+			or = append(or, bson.M{field: bson.M{"$type": typ}})
+		}
+	}
+
+	return bson.M{"$or": or}, nil
+}
+
+// Paginate returns the page of at most size documents following (or
+// preceding) the position encoded in token, ordered by sortKey and then by
+// _id so that the order is total. An empty token returns the first page.
+//
+// The sort key follows the Sort syntax, so "-created" pages from the newest
+// document to the oldest. When sortKey is empty the first field given to
+// Sort is used, falling back to _id. The fields given to Select must keep
+// the sort key and _id, which the tokens are made of, and size must be
+// positive. The documents whose sort key is null or missing, or of another
+// type, are paged in the order MongoDB sorts them, but the sort key must
+// hold scalars, ErrCursorValue being returned otherwise.
+//
+// Unlike Skip, the cost of fetching a page does not grow with its position,
+// and documents inserted concurrently do not shift the following pages:
+//
+//     page, err := Posts(r).Search(bson.M{"author": id}).Paginate("-created", token, 20)
+//     posts := page.Items.([]Post)
+//
+func (self *query) Paginate(sortKey string, token string, size int) (page *CursorPage, err error) {
+	if size < 1 {
+		return nil, ErrInvalidPage
+	}
+
+	e := &HookEvent{Operation: OperationSearch}
+	err = self.runEvent(e, func() error {
+		var err error
+		page, err = self.paginate(sortKey, token, size)
+		e.Document = page
+		return err
+	})
+	return page, err
+}
+
+func (self *query) paginate(sortKey string, token string, size int) (*CursorPage, error) {
+	if sortKey == "" {
+		if len(self.sort) > 0 {
+			sortKey = self.sort[0]
+		} else {
+			sortKey = "_id"
+		}
+	}
+
+	field, descending := sortKey, false
+	if strings.HasPrefix(field, "-") {
+		field, descending = field[1:], true
+	}
+
+	var cursor *cursorToken
+	if token != "" {
+		var err error
+		if cursor, err = decodeCursorToken(token); err != nil {
+			return nil, err
+		}
+		if cursor.Key != sortKey {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	if !selected(self.fields, field) || !selected(self.fields, "_id") {
+		return nil, ErrCursorFields
+	}
+
+	backward := cursor != nil && cursor.Back
+
+	// Walking backward is walking forward over the reversed order.
+	reverse := descending != backward
+	operator, direction := "$gt", ""
+	if reverse {
+		operator, direction = "$lt", "-"
+	}
+
+	selector := self.resolved
+	if cursor != nil {
+		after, err := cursorBound(field, cursor.Value, cursor.Id, operator)
+		if err != nil {
+			return nil, err
+		}
+		if selector == nil {
+			selector = after
+		} else {
+			selector = bson.M{"$and": []interface{}{selector, after}}
+		}
+	}
+
+	sort := []string{direction + field}
+	if field != "_id" {
+		sort = append(sort, direction+"_id")
+	}
+
+	iter := self.read(selector, sort, 0, size+1).Iter()
+
+	positions := make([]*cursorToken, 0, size)
+	more := false
+
+	// Every document read advances the position, including the ones left
+	// out by CollectHookErrors.
+	var positionErr error
+	next := func(raw *bson.Raw) bool {
+		if !iter.Next(raw) {
+			return false
+		}
+		if len(positions) == size {
+			more = true
+			return false
+		}
+
+		position := &cursorToken{Key: sortKey}
+		if positionErr = position.read(raw, field); positionErr != nil {
+			return false
+		}
+		positions = append(positions, position)
+		return true
+	}
+
+	slicet := reflect.SliceOf(self.operator.repository.typE)
+	slicev, err := self.operator.decodeAll(next, iter.Close, reflect.MakeSlice(slicet, 0, size), self.collectErrors)
+	if !slicev.IsValid() {
+		return nil, err
+	}
+	if positionErr != nil {
+		return nil, positionErr
+	}
+
+	if backward {
+		for i, j := 0, slicev.Len()-1; i < j; i, j = i+1, j-1 {
+			a, b := slicev.Index(i).Interface(), slicev.Index(j).Interface()
+			slicev.Index(i).Set(reflect.ValueOf(b))
+			slicev.Index(j).Set(reflect.ValueOf(a))
+		}
+		for i, j := 0, len(positions)-1; i < j; i, j = i+1, j-1 {
+			positions[i], positions[j] = positions[j], positions[i]
+		}
+	}
+
+	if err := self.operator.populate(slicev.Interface(), self.populate); err != nil {
+		return nil, err
+	}
+
+	page := &CursorPage{Items: slicev.Interface()}
+
+	if backward {
+		page.HasPrevious = more
+		page.HasNext = len(positions) > 0
+	} else {
+		page.HasNext = more
+		page.HasPrevious = cursor != nil && len(positions) > 0
+	}
+
+	if len(positions) > 0 {
+		first, last := positions[0], positions[len(positions)-1]
+		if page.HasNext {
+			if page.Next, err = last.encode(); err != nil {
+				return nil, err
+			}
+		}
+		if page.HasPrevious {
+			first.Back = true
+			if page.Previous, err = first.encode(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return page, err
+}
+
+// selected reports whether the projection fields keeps the field, given
+// in dot notation.
+func selected(fields interface{}, field string) bool {
+	if fields == nil {
+		return true
+	}
+
+	var projection bson.M
+	data, err := bson.Marshal(fields)
+	if err != nil || bson.Unmarshal(data, &projection) != nil {
+		return false
+	}
+
+	// A projection either includes or excludes fields, but for _id which
+	// is kept unless excluded.
+	inclusive, kept := false, field == "_id"
+	for name, value := range projection {
+		include, is := projected(value)
+		if !is {
+			continue
+		}
+		if include && name != "_id" {
+			inclusive = true
+		}
+		if name == field || strings.HasPrefix(field, name+".") {
+			if !include {
+				return false
+			}
+			kept = true
+		}
+	}
+	return kept || !inclusive
+}
+
+// projected returns whether the projection value includes its field, and
+// false for the operators such as $slice.
+func projected(value interface{}) (include bool, is bool) {
+	switch v := value.(type) {
+	case bool:
+		return v, true
+	case int:
+		return v != 0, true
+	case int64:
+		return v != 0, true
+	case float64:
+		return v != 0, true
+	}
+	return false, false
+}
+
+// read records the position of the raw document in the pagination order,
+// failing with ErrCursorValue when its sort key isn't a scalar.
+func (self *cursorToken) read(raw *bson.Raw, field string) error {
+	doc := bson.M{}
+	if err := raw.Unmarshal(&doc); err != nil {
+		return err
+	}
+
+	self.Id = doc["_id"]
+
+	var value interface{} = doc
+	for _, name := range strings.Split(field, ".") {
+		if m, ok := value.(bson.M); ok {
+			value = m[name]
+		} else {
+			value = nil
+			break
+		}
+	}
+	self.Value = value
+
+	if _, ok := sortRank(value); !ok && field != "_id" {
+		return ErrCursorValue
+	}
+	return nil
+}
+
+var ErrInvalidPage = errors.New("mongo: page number and page size must be positive")
+
+// OffsetPage is one page of an offset pagination. Items holds a slice of the
+// repository type and Total the number of documents matched by the query.
+type OffsetPage struct {
+	Items       interface{} `json:"items"`
+	Page        int         `json:"page"`
+	PageSize    int         `json:"pageSize"`
+	Total       int         `json:"total"`
+	Pages       int         `json:"pages"`
+	HasNext     bool        `json:"hasNext"`
+	HasPrevious bool        `json:"hasPrevious"`
+}
+
+// Page returns the pageNumber-th page (starting at 1) of pageSize documents
+// together with the total count of documents matched by the query. The
+// order given to Sort is kept; any Skip or Limit already set is replaced.
+//
+// For example:
+//
+//     page, err := Users(r).Search(bson.M{"active": true}).Sort("name").Page(3, 50)
+//     users := page.Items.([]User)
+//
+func (self *query) Page(pageNumber, pageSize int) (page *OffsetPage, err error) {
+	if pageNumber < 1 || pageSize < 1 {
+		return nil, ErrInvalidPage
+	}
+
+	e := &HookEvent{Operation: OperationSearch}
+	err = self.runEvent(e, func() error {
+		var err error
+		page, err = self.page(pageNumber, pageSize)
+		e.Document = page
+		return err
+	})
+	return page, err
+}
+
+func (self *query) page(pageNumber, pageSize int) (*OffsetPage, error) {
+
+	total, err := self.operator.count(self.resolved, 0, 0)
+	if err != nil {
+		return nil, self.operator.wrapError(err)
+	}
+
+	q := self.read(self.resolved, self.sort, (pageNumber-1)*pageSize, pageSize)
+
+	items, err := self.collect(q.Iter(), pageSize)
+	if items == nil {
+		return nil, err
+	}
+
+	pages := (total + pageSize - 1) / pageSize
+
+	return &OffsetPage{
+		Items:       items,
+		Page:        pageNumber,
+		PageSize:    pageSize,
+		Total:       total,
+		Pages:       pages,
+		HasNext:     pageNumber < pages,
+		HasPrevious: pageNumber > 1,
+	}, err
+}
@@ -0,0 +1,115 @@
+package mongo
+
+import (
+	"encoding/base64"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCursorTokenRoundTrip(t *testing.T) {
+	id := bson.NewObjectId()
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tokens := []*cursorToken{
+		{Key: "-created", Value: created, Id: id},
+		{Key: "name", Value: "a", Id: id, Back: true},
+		{Key: "rank", Value: 3, Id: 12},
+		{Key: "score", Value: 1.5, Id: "x"},
+		{Key: "deleted", Value: nil, Id: id},
+		{Key: "_id", Value: id, Id: id},
+	}
+	for _, token := range tokens {
+		encoded, err := token.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeCursorToken(encoded)
+		if err != nil {
+			t.Fatalf("%+v: %v", token, err)
+		}
+
+		if value, ok := token.Value.(time.Time); ok {
+			if !value.Equal(decoded.Value.(time.Time)) {
+				t.Errorf("%+v: decoded the value %v", token, decoded.Value)
+			}
+			decoded.Value = token.Value
+		}
+		if !reflect.DeepEqual(decoded, token) {
+			t.Errorf("decoded %+v, want %+v", decoded, token)
+		}
+	}
+}
+
+func TestCursorTokenInvalid(t *testing.T) {
+	forge := func(token bson.M) string {
+		data, err := bson.Marshal(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.URLEncoding.EncodeToString(data)
+	}
+
+	tokens := map[string]string{
+		"not base64":     "%%%",
+		"not bson":       base64.URLEncoding.EncodeToString([]byte("token")),
+		"operator value": forge(bson.M{"k": "name", "v": bson.M{"$regex": "."}, "i": 1}),
+		"array value":    forge(bson.M{"k": "name", "v": []int{1}, "i": 1}),
+		"regex value":    forge(bson.M{"k": "name", "v": bson.RegEx{Pattern: "."}, "i": 1}),
+		"missing id":     forge(bson.M{"k": "name", "v": "a"}),
+	}
+	for name, token := range tokens {
+		if _, err := decodeCursorToken(token); err != ErrInvalidCursor {
+			t.Errorf("%s: decodeCursorToken() = %v, want ErrInvalidCursor", name, err)
+		}
+	}
+}
+
+func TestCursorBound(t *testing.T) {
+	id := bson.NewObjectId()
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		operator string
+		want     []bson.M
+	}{
+		{"after null", nil, "$gt", []bson.M{
+			{"f": nil, "_id": bson.M{"$gt": id}},
+			{"f": bson.M{"$type": 1}}, {"f": bson.M{"$type": 16}}, {"f": bson.M{"$type": 18}}, {"f": bson.M{"$type": 19}},
+			{"f": bson.M{"$type": 2}}, {"f": bson.M{"$type": 14}},
+			{"f": bson.M{"$type": 3}}, {"f": bson.M{"$type": 4}}, {"f": bson.M{"$type": 5}}, {"f": bson.M{"$type": 7}},
+			{"f": bson.M{"$type": 8}}, {"f": bson.M{"$type": 9}}, {"f": bson.M{"$type": 17}}, {"f": bson.M{"$type": 11}},
+			{"f": bson.M{"$type": 127}},
+		}},
+		{"before null", nil, "$lt", []bson.M{
+			{"f": nil, "_id": bson.M{"$lt": id}},
+			{"f": bson.M{"$type": -1}},
+		}},
+		{"before a number", 5, "$lt", []bson.M{
+			{"f": bson.M{"$lt": 5}},
+			{"f": 5, "_id": bson.M{"$lt": id}},
+			{"f": bson.M{"$type": -1}},
+			{"f": nil},
+		}},
+	}
+	for _, test := range tests {
+		bound, err := cursorBound("f", test.value, id, test.operator)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(bound, bson.M{"$or": test.want}) {
+			t.Errorf("%s: bound %v, want %v", test.name, bound, test.want)
+		}
+	}
+
+	bound, err := cursorBound("_id", nil, id, "$gt")
+	if err != nil || !reflect.DeepEqual(bound, bson.M{"_id": bson.M{"$gt": id}}) {
+		t.Errorf("bound on _id %v, %v", bound, err)
+	}
+
+	if _, err := cursorBound("f", bson.M{"$ne": 1}, id, "$gt"); err != ErrCursorValue {
+		t.Errorf("cursorBound() = %v on a document, want ErrCursorValue", err)
+	}
+}
@@ -0,0 +1,692 @@
+package mongo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go4r/handy"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidPatch is matched by the errors returned for patches which
+	// are malformed, target unknown fields or can't be applied atomically.
+	ErrInvalidPatch = errors.New("mongo: invalid patch")
+
+	// ErrPatchTestFailed is returned when a test operation of a JSON Patch
+	// doesn't hold, or a replaced or removed member is missing.
+	ErrPatchTestFailed = errors.New("mongo: patch test failed")
+)
+
+// PatchOperation is an operation of a JSON Patch (RFC 6902).
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// patchUpdate is a patch translated into an update document, along with
+// the conditions the document must match for the patch to apply, the paths
+// written so far and the objects merged into fields by a merge patch.
+type patchUpdate struct {
+	set, unset, push, rename bson.M
+	conditions               bson.D
+	written                  []string
+	merges                   []patchMerge
+}
+
+// patchMerge is an object merged into a struct or map field by a merge
+// patch, with the value the field is set to when it holds no document to
+// merge into.
+type patchMerge struct {
+	path  string
+	value interface{}
+}
+
+// mergePatchAttempts is the number of times a merge patch is applied when
+// a merged field changes type between the read of the stored document and
+// the update.
+const mergePatchAttempts = 3
+
+func newPatchUpdate() *patchUpdate {
+	return &patchUpdate{set: bson.M{}, unset: bson.M{}, push: bson.M{}, rename: bson.M{}}
+}
+
+func (u *patchUpdate) document() bson.M {
+	update := bson.M{}
+	for operator, fields := range map[string]bson.M{"$set": u.set, "$unset": u.unset, "$push": u.push, "$rename": u.rename} {
+		if len(fields) > 0 {
+			update[operator] = fields
+		}
+	}
+	return update
+}
+
+// mergedFields returns the projection of the outermost merged fields.
+func (u *patchUpdate) mergedFields() bson.M {
+	fields := bson.M{}
+	for i, merge := range u.merges {
+		if !mergedWithin(u.merges[:i], merge.path) {
+			fields[merge.path] = 1
+		}
+	}
+	return fields
+}
+
+// resolve returns the update merging the objects into stored, the document
+// holding the merged fields. The fields which aren't documents are set as a
+// whole, as the server can't set their members, and the update is made
+// conditional on the fields keeping the type they have in stored.
+func (u *patchUpdate) resolve(stored bson.M) *patchUpdate {
+	resolved := &patchUpdate{set: bson.M{}, unset: bson.M{}, push: u.push, rename: u.rename}
+	resolved.conditions = append(bson.D{}, u.conditions...)
+	for path, value := range u.set {
+		resolved.set[path] = value
+	}
+	for path, value := range u.unset {
+		resolved.unset[path] = value
+	}
+
+	var replaced []patchMerge
+	for _, merge := range u.merges {
+		if mergedWithin(replaced, merge.path) {
+			continue
+		}
+
+		if _, ok := storedValue(stored, merge.path).(bson.M); ok {
+			resolved.conditions = append(resolved.conditions, bson.DocElem{Name: merge.path, Value: bson.M{"$type": 3}})
+			continue
+		}
+
+		for _, fields := range []bson.M{resolved.set, resolved.unset} {
+			for path := range fields {
+				if strings.HasPrefix(path, merge.path+".") {
+					delete(fields, path)
+				}
+			}
+		}
+		resolved.set[merge.path] = merge.value
+		resolved.conditions = append(resolved.conditions, bson.DocElem{Name: merge.path, Value: bson.M{"$not": bson.M{"$type": 3}}})
+		replaced = append(replaced, merge)
+	}
+	return resolved
+}
+
+// mergedWithin reports whether path is a member of one of the merged fields.
+func mergedWithin(merges []patchMerge, path string) bool {
+	for _, merge := range merges {
+		if strings.HasPrefix(path, merge.path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// storedValue returns the value at the dotted path of doc, or nil when
+// missing.
+func storedValue(doc bson.M, path string) interface{} {
+	var value interface{} = doc
+	for _, name := range strings.Split(path, ".") {
+		doc, ok := value.(bson.M)
+		if !ok {
+			return nil
+		}
+		value = doc[name]
+	}
+	return value
+}
+
+// write records path as written by the operation at. As the operations are
+// applied at once by a single update, it fails when an earlier operation
+// wrote the same member, or a member containing or contained by it, since
+// the update couldn't apply them in order.
+func (u *patchUpdate) write(at, path string) error {
+	for _, written := range u.written {
+		if overlappingPaths(written, path) {
+			return invalidPatch("%s: %q overlaps a member written by an earlier operation", at, path)
+		}
+	}
+	u.written = append(u.written, path)
+	return nil
+}
+
+// test adds the condition on path of the operation at. The conditions hold on
+// the stored document, so path can't have been written by an earlier
+// operation.
+func (u *patchUpdate) test(at, path string, condition interface{}) error {
+	for _, written := range u.written {
+		if overlappingPaths(written, path) {
+			return invalidPatch("%s: %q is tested after an earlier operation wrote it", at, path)
+		}
+	}
+	u.conditions = append(u.conditions, bson.DocElem{Name: path, Value: condition})
+	return nil
+}
+
+// add pushes value into the array at path, at position unless it's -1.
+// The values appended to the same array are pushed together, in order.
+func (u *patchUpdate) add(at, path string, value interface{}, position int) error {
+	if pushed, is := u.push[path].(bson.M); is && position < 0 && pushed["$position"] == nil {
+		pushed["$each"] = append(pushed["$each"].([]interface{}), value)
+		return nil
+	}
+
+	if err := u.write(at, path); err != nil {
+		return err
+	}
+
+	pushed := bson.M{"$each": []interface{}{value}}
+	if position >= 0 {
+		pushed["$position"] = position
+	}
+	u.push[path] = pushed
+	return nil
+}
+
+// overlappingPaths reports whether the dotted paths a and b are the same
+// member, or one contains the other.
+func overlappingPaths(a, b string) bool {
+	return a == b || strings.HasPrefix(b, a+".") || strings.HasPrefix(a, b+".")
+}
+
+// PatchDocument applies the JSON Patch (RFC 6902) patch to the stored doc
+// in a single atomic update, and loads the patched document into doc.
+//
+// The paths are JSON pointers on the JSON encoding of the document type
+// and the values are decoded into the type of their field, so patches
+// can't reach unknown fields. The add, replace, remove, move and test
+// operations are supported, add appending to arrays with "-" and
+// inserting at an index otherwise; copy and removals from arrays, which
+// have no atomic update, fail with ErrInvalidPatch. The tests, and the
+// existence of the replaced, removed and moved members, are checked
+// atomically with the update, ErrPatchTestFailed being returned when they
+// don't hold.
+//
+// As the operations are applied by a single update, a patch whose
+// operations can't be applied at once in the order given fails with
+// ErrInvalidPatch: a member written twice, or along with a member
+// containing it, or tested after being written. Only the values appended
+// to an array with "-" may follow each other, being pushed in order:
+//
+//     err := Users(r).PatchDocument(user, []byte(`[
+//             {"op": "test", "path": "/version", "value": 3},
+//             {"op": "replace", "path": "/email", "value": "a@b.c"},
+//             {"op": "add", "path": "/tags/-", "value": "admin"}
+//     ]`))
+//
+// It runs the update rewrite hook and the update hooks of doc.
+func (self *repositoryOperator) PatchDocument(doc DocumentWithPrimaryKey, patch []byte) error {
+	update, err := jsonPatchUpdate(self.repository.typE, patch)
+	if err != nil {
+		return err
+	}
+	return self.patch(doc.PrimaryKey(self.context), doc, update, nil)
+}
+
+// MergePatchDocument applies the JSON Merge Patch (RFC 7396) patch to the
+// stored doc in a single atomic update, and loads the patched document
+// into doc. Members set to null are removed, objects are merged into
+// struct and map fields and any other value replaces the field.
+//
+// An object merged into a field which is null, missing or not a document
+// sets the field as a whole, leaving out its null members. So the patches
+// merging objects read the stored document ahead of the update, which is
+// applied again when a merged field changes type in between.
+//
+// As with PatchDocument, only the fields of the document type can be
+// patched, and the update rewrite hook and the update hooks of doc run.
+func (self *repositoryOperator) MergePatchDocument(doc DocumentWithPrimaryKey, patch []byte) error {
+	update, err := mergePatchUpdate(self.repository.typE, patch)
+	if err != nil {
+		return err
+	}
+	return self.patch(doc.PrimaryKey(self.context), doc, update, nil)
+}
+
+// patch applies update to the document selected by document_selector with
+// findAndModify, provided it matches condition when not nil, decoding the
+// patched document into doc.
+func (self *repositoryOperator) patch(document_selector, doc interface{}, update *patchUpdate, condition interface{}) error {
+
+	e := &HookEvent{Operation: OperationUpdate, Selector: document_selector, Document: doc}
+
+	return self.run(e, func() error {
+		document_selector, err := self.rewrite(OperationUpdate, e.Selector)
+		if err != nil {
+			return err
+		}
+		e.Selector = document_selector
+
+		if doc, is := doc.(HookOnUpdate); is {
+			err := doc.HookOnUpdate(self.context, document_selector)
+			if err != nil {
+				return hookError("HookOnUpdate", err)
+			}
+		}
+
+		base := conditional(document_selector, condition)
+		selector := base
+		if len(update.conditions) > 0 {
+			selector = conditional(selector, update.conditions)
+		}
+
+		self.snapshot(e, selector)
+
+		var raw bson.Raw
+		for attempt := 1; ; attempt++ {
+			resolved := update
+			if len(update.merges) > 0 {
+				var stored bson.M
+				err = self.wrapError(self.collection.Find(base).Select(update.mergedFields()).One(&stored))
+				if err != nil {
+					break
+				}
+				resolved = update.resolve(stored)
+			}
+
+			selector := base
+			if len(resolved.conditions) > 0 {
+				selector = conditional(selector, resolved.conditions)
+			}
+
+			// An empty patch only checks its tests and loads the document.
+			if document := resolved.document(); len(document) > 0 {
+				change := mgo.Change{Update: document, ReturnNew: true}
+				_, err = self.collection.Find(selector).Apply(change, &raw)
+			} else {
+				err = self.collection.Find(selector).One(&raw)
+			}
+			err = self.wrapError(err)
+
+			// A merged field may have changed type since it was read.
+			if err != ErrNotFound || len(update.merges) == 0 || attempt == mergePatchAttempts {
+				break
+			}
+		}
+		e.written = err == nil
+
+		if err == ErrNotFound {
+			err = self.patchFailure(document_selector, update, condition)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := self.decode(&raw, doc); err != nil {
+			return err
+		}
+
+		if doc, is := doc.(HookAfterUpdate); is {
+			err := self.after(doc, "HookAfterUpdate", func(doc interface{}, c *handy.Context) error {
+				return doc.(HookAfterUpdate).HookAfterUpdate(c, document_selector)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// patchFailure returns the reason why the patch of the document selected
+// by document_selector matched nothing.
+func (self *repositoryOperator) patchFailure(document_selector interface{}, update *patchUpdate, condition interface{}) error {
+	if n, err := self.collection.Find(document_selector).Count(); err != nil || n == 0 {
+		return ErrNotFound
+	}
+
+	if condition != nil {
+		if n, err := self.collection.Find(conditional(document_selector, condition)).Count(); err == nil && n == 0 {
+			return ErrPreconditionFailed
+		}
+	}
+
+	if len(update.conditions) > 0 {
+		return ErrPatchTestFailed
+	}
+	return ErrNotFound
+}
+
+func invalidPatch(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPatch, fmt.Sprintf(format, args...))
+}
+
+// jsonPatchUpdate translates the JSON Patch patch on documents of typ.
+func jsonPatchUpdate(typ reflect.Type, patch []byte) (*patchUpdate, error) {
+	var operations []PatchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, invalidPatch("%v", err)
+	}
+
+	update := newPatchUpdate()
+
+	for i, operation := range operations {
+		at := fmt.Sprintf("operation %d", i)
+		target, err := resolvePatchPath(typ, operation.Path)
+		if err != nil {
+			return nil, invalidPatch("operation %d: %v", i, err)
+		}
+
+		switch operation.Op {
+		case "add", "replace", "test":
+			value, err := decodePatchValue(target.typ, operation.Value)
+			if err != nil {
+				return nil, invalidPatch("operation %d: %v", i, err)
+			}
+
+			// Replaced and tested array elements are addressed by their
+			// index, as the members of a document.
+			path := target.path
+			if target.index != "" && operation.Op != "add" {
+				if target.index == "-" {
+					return nil, invalidPatch("operation %d: invalid array index in %q", i, operation.Path)
+				}
+				path += "." + target.index
+			}
+
+			switch {
+			case operation.Op == "test":
+				err = update.test(at, path, value)
+			case operation.Op == "add" && target.index == "-":
+				err = update.add(at, target.path, value, -1)
+			case operation.Op == "add" && target.index != "":
+				position, _ := strconv.Atoi(target.index)
+				err = update.add(at, target.path, value, position)
+			default:
+				if operation.Op == "replace" {
+					err = update.test(at, path, bson.M{"$exists": true})
+				}
+				if err == nil {
+					err = update.write(at, path)
+				}
+				update.set[path] = value
+			}
+			if err != nil {
+				return nil, err
+			}
+		case "remove":
+			if target.index != "" {
+				return nil, invalidPatch("operation %d: array elements can't be removed atomically", i)
+			}
+			if err := update.test(at, target.path, bson.M{"$exists": true}); err != nil {
+				return nil, err
+			}
+			if err := update.write(at, target.path); err != nil {
+				return nil, err
+			}
+			update.unset[target.path] = ""
+		case "move":
+			from, err := resolvePatchPath(typ, operation.From)
+			if err != nil {
+				return nil, invalidPatch("operation %d: %v", i, err)
+			}
+			if target.index != "" || from.index != "" {
+				return nil, invalidPatch("operation %d: array elements can't be moved atomically", i)
+			}
+			if from.typ != target.typ {
+				return nil, invalidPatch("operation %d: %s and %s have different types", i, operation.From, operation.Path)
+			}
+			if err := update.test(at, from.path, bson.M{"$exists": true}); err != nil {
+				return nil, err
+			}
+			if err := update.write(at, from.path); err != nil {
+				return nil, err
+			}
+			if err := update.write(at, target.path); err != nil {
+				return nil, err
+			}
+			update.rename[from.path] = target.path
+		default:
+			return nil, invalidPatch("operation %d: unsupported op %q", i, operation.Op)
+		}
+	}
+
+	return update, nil
+}
+
+// mergePatchUpdate translates the JSON Merge Patch patch on documents of
+// typ.
+func mergePatchUpdate(typ reflect.Type, patch []byte) (*patchUpdate, error) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &members); err != nil || members == nil {
+		return nil, invalidPatch("a merge patch must be an object")
+	}
+
+	update := newPatchUpdate()
+	if err := mergePatchMembers(typ, "", members, update); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+func mergePatchMembers(typ reflect.Type, pointer string, members map[string]json.RawMessage, update *patchUpdate) error {
+	for name, raw := range members {
+		member := pointer + "/" + strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+
+		target, err := resolvePatchPath(typ, member)
+		if err != nil {
+			return invalidPatch("%v", err)
+		}
+		if target.index != "" {
+			return invalidPatch("%s: arrays are replaced as a whole", member)
+		}
+
+		raw = bytes.TrimSpace(raw)
+		if bytes.Equal(raw, []byte("null")) {
+			if err := update.write(member, target.path); err != nil {
+				return err
+			}
+			update.unset[target.path] = ""
+			continue
+		}
+
+		elem := target.typ
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+		mergeable := (elem.Kind() == reflect.Struct && elem != timeType) || elem.Kind() == reflect.Map
+
+		if len(raw) > 0 && raw[0] == '{' && mergeable {
+			var nested map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &nested); err != nil {
+				return invalidPatch("%s: %v", member, err)
+			}
+
+			whole, err := withoutNulls(raw)
+			if err == nil {
+				var value interface{}
+				if value, err = decodePatchValue(target.typ, whole); err == nil {
+					update.merges = append(update.merges, patchMerge{path: target.path, value: value})
+				}
+			}
+			if err != nil {
+				return invalidPatch("%s: %v", member, err)
+			}
+
+			if err := mergePatchMembers(typ, member, nested, update); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, err := decodePatchValue(target.typ, raw)
+		if err != nil {
+			return invalidPatch("%s: %v", member, err)
+		}
+		if err := update.write(member, target.path); err != nil {
+			return err
+		}
+		update.set[target.path] = value
+	}
+
+	return nil
+}
+
+// withoutNulls returns the JSON object raw without its null members, at any
+// depth, which is the result of merging raw into null.
+func withoutNulls(raw json.RawMessage) (json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(removeNulls(value))
+}
+
+func removeNulls(value interface{}) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	for name, member := range object {
+		if member == nil {
+			delete(object, name)
+		} else {
+			object[name] = removeNulls(member)
+		}
+	}
+	return object
+}
+
+// decodePatchValue decodes the JSON value raw into a value of typ.
+func decodePatchValue(typ reflect.Type, raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("missing value")
+	}
+
+	value := reflect.New(typ)
+	if err := json.Unmarshal(raw, value.Interface()); err != nil {
+		return nil, err
+	}
+	return value.Elem().Interface(), nil
+}
+
+// patchTarget is the field a JSON pointer resolves to: its dotted path,
+// its type and, when it points into an array, the index or "-".
+type patchTarget struct {
+	path  string
+	typ   reflect.Type
+	index string
+}
+
+// resolvePatchPath resolves the JSON pointer on the JSON encoding of the
+// documents of typ.
+func resolvePatchPath(typ reflect.Type, pointer string) (*patchTarget, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q", pointer)
+	}
+
+	segments := strings.Split(pointer[1:], "/")
+	var path []string
+	target := &patchTarget{typ: typ}
+
+	for i, segment := range segments {
+		segment = strings.Replace(strings.Replace(segment, "~1", "/", -1), "~0", "~", -1)
+		last := i == len(segments)-1
+
+		for target.typ.Kind() == reflect.Ptr {
+			target.typ = target.typ.Elem()
+		}
+
+		switch target.typ.Kind() {
+		case reflect.Struct:
+			names, typ, ok := jsonField(target.typ, segment)
+			if !ok || target.typ == timeType {
+				return nil, fmt.Errorf("unknown field %q", pointer)
+			}
+			path = append(path, names...)
+			target.typ = typ
+		case reflect.Slice, reflect.Array:
+			if segment != "-" {
+				if _, err := strconv.ParseUint(segment, 10, 0); err != nil {
+					return nil, fmt.Errorf("invalid array index in %q", pointer)
+				}
+			}
+			if !last {
+				if segment == "-" {
+					return nil, fmt.Errorf("invalid array index in %q", pointer)
+				}
+				path = append(path, segment)
+			} else {
+				target.index = segment
+			}
+			target.typ = target.typ.Elem()
+		case reflect.Map, reflect.Interface:
+			if target.typ.Kind() == reflect.Map && target.typ.Key().Kind() != reflect.String {
+				return nil, fmt.Errorf("unknown field %q", pointer)
+			}
+			if segment == "" || strings.ContainsAny(segment, ".$") {
+				return nil, fmt.Errorf("invalid key %q in %q", segment, pointer)
+			}
+			path = append(path, segment)
+			if target.typ.Kind() == reflect.Map {
+				target.typ = target.typ.Elem()
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q", pointer)
+		}
+	}
+
+	target.path = strings.Join(path, ".")
+	if target.path == "_id" || strings.HasPrefix(target.path, "_id.") {
+		return nil, errors.New("the _id can't be patched")
+	}
+	return target, nil
+}
+
+// jsonField returns the bson path and the type of the field of the struct
+// typ encoded under name in JSON.
+func jsonField(typ reflect.Type, name string) ([]string, reflect.Type, bool) {
+	var folded *reflect.StructField
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+
+		key, inline := bsonFieldName(field)
+		if key == "-" {
+			continue
+		}
+
+		if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+			if names, typ, ok := jsonField(field.Type, name); ok {
+				if !inline {
+					names = append([]string{key}, names...)
+				}
+				return names, typ, true
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if tag == "" {
+			tag = field.Name
+		}
+		if tag == name {
+			return []string{key}, field.Type, true
+		}
+		if folded == nil && strings.EqualFold(tag, name) {
+			folded = &field
+		}
+	}
+
+	if folded != nil {
+		key, _ := bsonFieldName(*folded)
+		return []string{key}, folded.Type, true
+	}
+	return nil, nil, false
+}
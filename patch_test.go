@@ -0,0 +1,250 @@
+package mongo
+
+import (
+	"errors"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+)
+
+type patchTestAddress struct {
+	City string `bson:"city" json:"city"`
+	Zip  string `bson:"zip" json:"zip"`
+}
+
+type patchTestDocument struct {
+	Id      bson.ObjectId    `bson:"_id" json:"id"`
+	Name    string           `bson:"name" json:"name"`
+	Version int              `bson:"version" json:"version"`
+	Tags    []string         `bson:"tags" json:"tags"`
+	Address patchTestAddress `bson:"address" json:"address"`
+	Meta    map[string]int   `bson:"meta" json:"meta"`
+}
+
+var patchTestType = reflect.TypeOf(patchTestDocument{})
+
+func TestJSONPatchUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		patch      string
+		update     bson.M
+		conditions bson.D
+	}{
+		{
+			name:   "replace",
+			patch:  `[{"op": "replace", "path": "/name", "value": "bob"}]`,
+			update: bson.M{"$set": bson.M{"name": "bob"}},
+			conditions: bson.D{
+				{Name: "name", Value: bson.M{"$exists": true}},
+			},
+		},
+		{
+			name:   "test then replace",
+			patch:  `[{"op": "test", "path": "/version", "value": 3}, {"op": "replace", "path": "/version", "value": 4}]`,
+			update: bson.M{"$set": bson.M{"version": 4}},
+			conditions: bson.D{
+				{Name: "version", Value: 3},
+				{Name: "version", Value: bson.M{"$exists": true}},
+			},
+		},
+		{
+			name:   "appends pushed in order",
+			patch:  `[{"op": "add", "path": "/tags/-", "value": "a"}, {"op": "add", "path": "/tags/-", "value": "b"}]`,
+			update: bson.M{"$push": bson.M{"tags": bson.M{"$each": []interface{}{"a", "b"}}}},
+		},
+		{
+			name:   "insert at index",
+			patch:  `[{"op": "add", "path": "/tags/1", "value": "a"}]`,
+			update: bson.M{"$push": bson.M{"tags": bson.M{"$each": []interface{}{"a"}, "$position": 1}}},
+		},
+		{
+			name:   "replace array element",
+			patch:  `[{"op": "replace", "path": "/tags/2", "value": "a"}]`,
+			update: bson.M{"$set": bson.M{"tags.2": "a"}},
+			conditions: bson.D{
+				{Name: "tags.2", Value: bson.M{"$exists": true}},
+			},
+		},
+		{
+			name:   "remove and map member",
+			patch:  `[{"op": "remove", "path": "/name"}, {"op": "add", "path": "/meta/views", "value": 2}]`,
+			update: bson.M{"$unset": bson.M{"name": ""}, "$set": bson.M{"meta.views": 2}},
+			conditions: bson.D{
+				{Name: "name", Value: bson.M{"$exists": true}},
+			},
+		},
+		{
+			name:   "move",
+			patch:  `[{"op": "move", "from": "/address/city", "path": "/address/zip"}]`,
+			update: bson.M{"$rename": bson.M{"address.city": "address.zip"}},
+			conditions: bson.D{
+				{Name: "address.city", Value: bson.M{"$exists": true}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		update, err := jsonPatchUpdate(patchTestType, []byte(test.patch))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if document := update.document(); !reflect.DeepEqual(document, test.update) {
+			t.Errorf("%s: update %#v, want %#v", test.name, document, test.update)
+		}
+		if !reflect.DeepEqual(update.conditions, test.conditions) {
+			t.Errorf("%s: conditions %#v, want %#v", test.name, update.conditions, test.conditions)
+		}
+	}
+}
+
+func TestJSONPatchUpdateInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+	}{
+		{"malformed", `{"op": "add"}`},
+		{"unknown op", `[{"op": "copy", "from": "/name", "path": "/name"}]`},
+		{"unknown field", `[{"op": "replace", "path": "/missing", "value": 1}]`},
+		{"wrong type", `[{"op": "replace", "path": "/version", "value": "three"}]`},
+		{"id", `[{"op": "replace", "path": "/id", "value": "x"}]`},
+		{"remove array element", `[{"op": "remove", "path": "/tags/0"}]`},
+		{"replace append index", `[{"op": "replace", "path": "/tags/-", "value": "a"}]`},
+		{"same path twice", `[{"op": "replace", "path": "/name", "value": "a"}, {"op": "remove", "path": "/name"}]`},
+		{"parent and child", `[{"op": "replace", "path": "/address/city", "value": "a"}, {"op": "remove", "path": "/address"}]`},
+		{"child and parent", `[{"op": "remove", "path": "/address"}, {"op": "add", "path": "/address/city", "value": "a"}]`},
+		{"test after write", `[{"op": "replace", "path": "/version", "value": 4}, {"op": "test", "path": "/version", "value": 4}]`},
+		{"append after insert", `[{"op": "add", "path": "/tags/0", "value": "a"}, {"op": "add", "path": "/tags/-", "value": "b"}]`},
+		{"set after append", `[{"op": "add", "path": "/tags/-", "value": "a"}, {"op": "replace", "path": "/tags/0", "value": "b"}]`},
+		{"move onto written", `[{"op": "replace", "path": "/address/zip", "value": "a"}, {"op": "move", "from": "/address/city", "path": "/address/zip"}]`},
+	}
+
+	for _, test := range tests {
+		if _, err := jsonPatchUpdate(patchTestType, []byte(test.patch)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("%s: error %v, want ErrInvalidPatch", test.name, err)
+		}
+	}
+}
+
+func TestMergePatchUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		patch  string
+		update bson.M
+	}{
+		{
+			name:   "set and remove",
+			patch:  `{"name": "bob", "version": null}`,
+			update: bson.M{"$set": bson.M{"name": "bob"}, "$unset": bson.M{"version": ""}},
+		},
+		{
+			name:   "nested struct merged",
+			patch:  `{"address": {"city": "Paris"}}`,
+			update: bson.M{"$set": bson.M{"address.city": "Paris"}},
+		},
+		{
+			name:   "map merged",
+			patch:  `{"meta": {"views": 3, "likes": null}}`,
+			update: bson.M{"$set": bson.M{"meta.views": 3}, "$unset": bson.M{"meta.likes": ""}},
+		},
+		{
+			name:   "array replaced",
+			patch:  `{"tags": ["a", "b"]}`,
+			update: bson.M{"$set": bson.M{"tags": []string{"a", "b"}}},
+		},
+	}
+
+	for _, test := range tests {
+		update, err := mergePatchUpdate(patchTestType, []byte(test.patch))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if document := update.document(); !reflect.DeepEqual(document, test.update) {
+			t.Errorf("%s: update %#v, want %#v", test.name, document, test.update)
+		}
+	}
+}
+
+func TestMergePatchUpdateInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+	}{
+		{"not an object", `["name"]`},
+		{"null patch", `null`},
+		{"unknown field", `{"missing": 1}`},
+		{"wrong type", `{"version": "three"}`},
+		{"id", `{"id": "x"}`},
+		{"same field twice", `{"name": "a", "Name": "b"}`},
+	}
+
+	for _, test := range tests {
+		if _, err := mergePatchUpdate(patchTestType, []byte(test.patch)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("%s: error %v, want ErrInvalidPatch", test.name, err)
+		}
+	}
+}
+
+func TestMergePatchResolve(t *testing.T) {
+	update, err := mergePatchUpdate(patchTestType, []byte(`{"name": "bob", "address": {"city": "Paris", "zip": null}, "meta": {"views": 3}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fields := update.mergedFields(); !reflect.DeepEqual(fields, bson.M{"address": 1, "meta": 1}) {
+		t.Fatalf("merged fields %v", fields)
+	}
+
+	tests := []struct {
+		name       string
+		stored     bson.M
+		update     bson.M
+		conditions bson.D
+	}{
+		{
+			name:   "documents",
+			stored: bson.M{"address": bson.M{"city": "Rome"}, "meta": bson.M{}},
+			update: bson.M{"$set": bson.M{"name": "bob", "address.city": "Paris", "meta.views": 3}, "$unset": bson.M{"address.zip": ""}},
+			conditions: bson.D{
+				{Name: "address", Value: bson.M{"$type": 3}},
+				{Name: "meta", Value: bson.M{"$type": 3}},
+			},
+		},
+		{
+			name:   "null and missing",
+			stored: bson.M{"address": nil},
+			update: bson.M{"$set": bson.M{
+				"name":    "bob",
+				"address": patchTestAddress{City: "Paris"},
+				"meta":    map[string]int{"views": 3},
+			}},
+			conditions: bson.D{
+				{Name: "address", Value: bson.M{"$not": bson.M{"$type": 3}}},
+				{Name: "meta", Value: bson.M{"$not": bson.M{"$type": 3}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		resolved := update.resolve(test.stored)
+		if document := resolved.document(); !reflect.DeepEqual(document, test.update) {
+			t.Errorf("%s: update %#v, want %#v", test.name, document, test.update)
+		}
+
+		conditions := bson.M{}
+		for _, condition := range resolved.conditions {
+			conditions[condition.Name] = condition.Value
+		}
+		want := bson.M{}
+		for _, condition := range test.conditions {
+			want[condition.Name] = condition.Value
+		}
+		if !reflect.DeepEqual(conditions, want) {
+			t.Errorf("%s: conditions %v, want %v", test.name, resolved.conditions, test.conditions)
+		}
+	}
+
+	if document := update.document(); len(document["$set"].(bson.M)) != 3 {
+		t.Errorf("resolve modified the update %v", document)
+	}
+}
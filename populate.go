@@ -0,0 +1,371 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"strings"
+)
+
+// Populate asks the query to resolve the references found at the given
+// paths once the documents are loaded. A reference is declared on the
+// field receiving the referenced document with the populate tag, naming
+// the field holding the id (or the slice of ids) and optionally the
+// collection of the referenced repository, which defaults to the
+// repository registered for the field type:
+//
+//     type Comment struct {
+//             UserId bson.ObjectId `bson:"user"`
+//             User   *User         `bson:"-" populate:"user"`
+//     }
+//
+//     type Post struct {
+//             AuthorId bson.ObjectId   `bson:"author"`
+//             Author   *User           `bson:"-" populate:"author,users"`
+//             Comments []Comment       `bson:"comments"`
+//             TagIds   []bson.ObjectId `bson:"tags"`
+//             Tags     []*Tag          `bson:"-" populate:"tags"`
+//     }
+//
+//     posts, err := Posts(r).Search(nil).Populate("author", "comments.user", "tags").GetAllE()
+//
+// The references are fetched with a single query per referenced repository,
+// going through its middlewares and its rewrite and search hooks, and the
+// load hooks run on the populated documents. The ids are matched whatever
+// their integer type, the ObjectId hex strings match the ObjectIds, and
+// the ids which are documents or arrays match by their content. The
+// failures to populate fail the reads with a PopulateError, which GetAll
+// and GetOne log as they return nil.
+func (self *query) Populate(paths ...string) *query {
+	self.populate = append(self.populate, paths...)
+	return self
+}
+
+// populateSlot is a field waiting for the documents referenced by ids.
+type populateSlot struct {
+	field reflect.Value
+	ids   []interface{}
+	many  bool
+}
+
+type populateBatch struct {
+	repository *repository
+	slots      []*populateSlot
+}
+
+// populate resolves the references at paths within value, which may be a
+// document, a slice of documents or a pointer to either.
+func (self *repositoryOperator) populate(value interface{}, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	batches := map[*repository]*populateBatch{}
+	for _, path := range paths {
+		err := collectPopulateSlots(reflect.ValueOf(value), strings.Split(path, "."), path, batches)
+		if err != nil {
+			return &PopulateError{Paths: paths, Err: err}
+		}
+	}
+
+	for repository, batch := range batches {
+		if err := self.populateBatch(repository, batch); err != nil {
+			return &PopulateError{Paths: paths, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// PopulateError is returned by the reads failing to populate the documents
+// loaded. It unwraps to the cause of the failure.
+type PopulateError struct {
+	Paths []string
+	Err   error
+}
+
+func (e *PopulateError) Error() string {
+	return "mongo: populating " + strings.Join(e.Paths, ", ") + " failed: " + e.Err.Error()
+}
+
+func (e *PopulateError) Unwrap() error {
+	return e.Err
+}
+
+func (self *repositoryOperator) populateBatch(repository *repository, batch *populateBatch) error {
+	var ids []interface{}
+	for _, slot := range batch.slots {
+		for _, id := range slot.ids {
+			ids = append(ids, id)
+			if alias, ok := populateAlias(id); ok {
+				ids = append(ids, alias)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// The referenced repository shares the session and context.Context of
+	// the operator loading the documents.
+	operator := &repositoryOperator{
+		repository: repository,
+		context:    self.context,
+		collection: self.collection.Database.C(repository.collection),
+		ctx:        self.ctx,
+	}
+
+	documents := map[interface{}]reflect.Value{}
+
+	q := operator.Search(bson.M{"_id": bson.M{"$in": ids}})
+	err := q.run(nil, func() error {
+		return operator.fetchPopulated(q.resolved, documents)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range batch.slots {
+		if !slot.many {
+			if document, ok := documents[populateKey(slot.ids[0])]; ok {
+				slot.field.Set(adaptPopulated(document, slot.field.Type()))
+			}
+			continue
+		}
+
+		slicev := reflect.MakeSlice(slot.field.Type(), 0, len(slot.ids))
+		for _, id := range slot.ids {
+			if document, ok := documents[populateKey(id)]; ok {
+				slicev = reflect.Append(slicev, adaptPopulated(document, slot.field.Type().Elem()))
+			}
+		}
+		slot.field.Set(slicev)
+	}
+
+	return nil
+}
+
+// fetchPopulated loads the documents matching selector into documents,
+// indexed by _id.
+func (self *repositoryOperator) fetchPopulated(selector interface{}, documents map[interface{}]reflect.Value) error {
+	iter := self.collection.Find(selector).Iter()
+
+	var raw bson.Raw
+	for iter.Next(&raw) {
+		var key struct {
+			Id interface{} `bson:"_id"`
+		}
+		if err := raw.Unmarshal(&key); err != nil {
+			iter.Close()
+			return err
+		}
+
+		elemp := reflect.New(self.repository.typE)
+		if err := self.decode(&raw, elemp.Interface()); err != nil {
+			iter.Close()
+			return err
+		}
+		documents[populateKey(key.Id)] = elemp
+	}
+
+	return self.wrapError(iter.Close())
+}
+
+// populateKey returns the id the populated documents are matched by: the
+// integers as int64 and the ObjectId hex strings as ObjectIds, as the
+// references and the _id may be decoded into either. The ids which can't
+// be map keys, such as documents, are matched by their BSON encoding.
+func populateKey(id interface{}) interface{} {
+	if alias, ok := populateAlias(id); ok {
+		return alias
+	}
+	if id != nil && !reflect.TypeOf(id).Comparable() {
+		return encodePopulateKey(id)
+	}
+	return id
+}
+
+// populateAlias returns the other form id may be stored in, if any.
+func populateAlias(id interface{}) (interface{}, bool) {
+	switch id := id.(type) {
+	case int:
+		return int64(id), true
+	case int32:
+		return int64(id), true
+	case string:
+		if bson.IsObjectIdHex(id) {
+			return bson.ObjectIdHex(id), true
+		}
+	}
+	return nil, false
+}
+
+// populateEncodedKey is the key of the ids matched by their encoding, with
+// the fields of the documents sorted, as the ids decoded from the database
+// are maps.
+type populateEncodedKey string
+
+func encodePopulateKey(id interface{}) interface{} {
+	data, err := bson.Marshal(bson.M{"_id": id})
+	if err == nil {
+		data, err = sortedDocument(data, false)
+	}
+	if err != nil {
+		// The id can't be stored then, and matches nothing.
+		return populateEncodedKey(err.Error())
+	}
+	return populateEncodedKey(data)
+}
+
+// adaptPopulated returns the document pointer as typ, which is either the
+// pointer type itself or the document type.
+func adaptPopulated(document reflect.Value, typ reflect.Type) reflect.Value {
+	if typ.Kind() == reflect.Ptr {
+		return document
+	}
+	return document.Elem()
+}
+
+// collectPopulateSlots walks value along segments, grouping the fields to
+// be populated by referenced repository.
+func collectPopulateSlots(value reflect.Value, segments []string, path string, batches map[*repository]*populateBatch) error {
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			if err := collectPopulateSlots(value.Index(i), segments, path, batches); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+	default:
+		return fmt.Errorf("mongo: cannot populate %q through %s", path, value.Type())
+	}
+
+	if len(segments) > 1 {
+		field, ok := fieldByBSONName(value, segments[0])
+		if !ok {
+			return fmt.Errorf("mongo: cannot populate %q, %s has no field %q", path, value.Type(), segments[0])
+		}
+		return collectPopulateSlots(field, segments[1:], path, batches)
+	}
+
+	ids, ok := fieldByBSONName(value, segments[0])
+	if !ok {
+		return fmt.Errorf("mongo: cannot populate %q, %s has no field %q", path, value.Type(), segments[0])
+	}
+
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		tag := typ.Field(i).Tag.Get("populate")
+		if tag == "" {
+			continue
+		}
+
+		options := strings.Split(tag, ",")
+		if options[0] != segments[0] {
+			continue
+		}
+
+		field := value.Field(i)
+		if !field.CanSet() {
+			return fmt.Errorf("mongo: cannot populate %q, field %s is not settable", path, typ.Field(i).Name)
+		}
+
+		slot := &populateSlot{field: field}
+
+		target := field.Type()
+		if target.Kind() == reflect.Slice {
+			slot.many = true
+			target = target.Elem()
+			for j := 0; j < ids.Len(); j++ {
+				slot.ids = append(slot.ids, ids.Index(j).Interface())
+			}
+		} else {
+			if ids.IsZero() {
+				return nil
+			}
+			slot.ids = []interface{}{ids.Interface()}
+		}
+
+		if target.Kind() == reflect.Ptr {
+			target = target.Elem()
+		}
+
+		collection := ""
+		if len(options) > 1 {
+			collection = options[1]
+		}
+
+		repository := lookupRepository(target, collection)
+		if repository == nil || repository.typE != target {
+			return fmt.Errorf("mongo: cannot populate %q, no repository registered for %s", path, target)
+		}
+
+		batch := batches[repository]
+		if batch == nil {
+			batch = &populateBatch{repository: repository}
+			batches[repository] = batch
+		}
+		batch.slots = append(batch.slots, slot)
+
+		return nil
+	}
+
+	return errors.New("mongo: no field is tagged to populate " + path)
+}
+
+// fieldByBSONName returns the field of the struct value stored under name,
+// looking into inlined structs as well.
+func fieldByBSONName(value reflect.Value, name string) (reflect.Value, bool) {
+	typ := value.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		key, inline := bsonFieldName(field)
+		if inline && field.Type.Kind() == reflect.Struct {
+			if found, ok := fieldByBSONName(value.Field(i), name); ok {
+				return found, true
+			}
+			continue
+		}
+
+		if key == name {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// bsonFieldName returns the key a struct field is stored under, following
+// the rules of the bson package, and whether the field is inlined.
+func bsonFieldName(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("bson")
+	if tag == "" && !strings.Contains(string(field.Tag), ":") {
+		tag = string(field.Tag)
+	}
+
+	options := strings.Split(tag, ",")
+	inline := false
+	for _, option := range options[1:] {
+		if option == "inline" {
+			inline = true
+		}
+	}
+
+	if options[0] == "" {
+		return strings.ToLower(field.Name), inline
+	}
+	return options[0], inline
+}
@@ -0,0 +1,65 @@
+package mongo
+
+import (
+	"errors"
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+type populateTestAuthor struct {
+	Id bson.ObjectId `bson:"_id"`
+}
+
+type populateTestPost struct {
+	AuthorId bson.ObjectId       `bson:"author"`
+	Author   *populateTestAuthor `bson:"-" populate:"author,populate_test_authors"`
+}
+
+func TestPopulateKey(t *testing.T) {
+	id := bson.NewObjectId()
+
+	tests := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"integers", 42, int64(42)},
+		{"int32", int32(42), int64(42)},
+		{"ObjectId hex", id.Hex(), id},
+		{"documents", bson.M{"a": 1, "b": "x"}, bson.D{{Name: "b", Value: "x"}, {Name: "a", Value: 1}}},
+		{"arrays", []interface{}{1, "x"}, []interface{}{1, "x"}},
+	}
+	for _, test := range tests {
+		if populateKey(test.a) != populateKey(test.b) {
+			t.Errorf("%s: %v and %v don't match", test.name, test.a, test.b)
+		}
+	}
+
+	if populateKey(bson.M{"a": 1}) == populateKey(bson.M{"a": 2}) {
+		t.Error("different documents match")
+	}
+	if populateKey([]interface{}{1, 2}) == populateKey([]interface{}{2, 1}) {
+		t.Error("arrays match whatever the order of their elements")
+	}
+}
+
+func TestPopulateMiddlewares(t *testing.T) {
+	NewRepositoryCollection("populate_test_authors", &populateTestAuthor{})
+
+	errStop := errors.New("stop")
+	var e *HookEvent
+	UseFor("populate_test_authors", Middleware{Before: func(event *HookEvent) error {
+		e = event
+		return errStop
+	}})
+
+	post := &populateTestPost{AuthorId: bson.NewObjectId()}
+	err := testOperator(&populateTestPost{}).populate(post, []string{"author"})
+
+	var populateErr *PopulateError
+	if !errors.As(err, &populateErr) || !errors.Is(err, errStop) {
+		t.Fatalf("populate() = %v, want a PopulateError from the middleware", err)
+	}
+	if e == nil || e.Operation != OperationSearch || e.Collection != "populate_test_authors" {
+		t.Fatalf("the middleware saw %+v, want the search of the authors", e)
+	}
+}
@@ -1,25 +1,108 @@
 package mongo
 
 import (
+	"errors"
+	"github.com/go4r/handy"
 	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
 	"reflect"
 )
 
 type query struct {
 	operator *repositoryOperator
-	query *mgo.Query
-	limit int
+	query    *mgo.Query
+	limit    int
+	skip     int
+	selector interface{}
+	resolved interface{}
+	sort     []string
+	fields   interface{}
+	options  []func(*mgo.Query)
+	populate []string
+
+	// modifiers is set once mgo writes query modifiers of its own, see
+	// read.
+	modifiers bool
+
+	collectErrors bool
 }
 
-// Count returns the total number of documents in the result set.
+// derive builds a fresh mgo query over selector carrying the options
+// (Batch, Prefetch, Select, Hint, Snapshot, LogReplay) already applied to
+// this query, but not its order and range.
+func (self *query) derive(selector interface{}) *mgo.Query {
+	q := self.operator.collection.Find(selector)
+	for _, option := range self.options {
+		option(q)
+	}
+	return q
+}
+
+// build builds a fresh mgo query over selector carrying everything already
+// applied to this query.
+func (self *query) build(selector interface{}) *mgo.Query {
+	q := self.derive(selector)
+	if len(self.sort) > 0 {
+		q.Sort(self.sort...)
+	}
+	if self.skip > 0 {
+		q.Skip(self.skip)
+	}
+	if self.limit > 0 {
+		q.Limit(self.limit)
+	}
+	return q
+}
+
+// collect drains iter into a slice of the repository type, running the load
+// hooks on every document. The iterator is always closed.
+func (self *query) collect(iter *mgo.Iter, capacity int) (interface{}, error) {
+	next := func(raw *bson.Raw) bool {
+		return iter.Next(raw)
+	}
+
+	slicet := reflect.SliceOf(self.operator.repository.typE)
+	slicev, err := self.operator.decodeAll(next, iter.Close, reflect.MakeSlice(slicet, 0, capacity), self.collectErrors)
+	if !slicev.IsValid() {
+		return nil, err
+	}
+
+	if err := self.operator.populate(slicev.Interface(), self.populate); err != nil {
+		return nil, err
+	}
+
+	return slicev.Interface(), err
+}
+
+// CollectHookErrors makes the reads of the query leave out the documents
+// whose load hooks fail instead of aborting. The documents loaded are
+// returned along with the HookErrors of the ones left out.
+func (self *query) CollectHookErrors() *query {
+	self.collectErrors = true
+	return self
+}
+
+// Count returns the total number of documents in the result set, or -1 on
+// any error. See CountE.
 func (q *query) Count() int {
-	count, err := q.query.Count()
+	count, err := q.CountE()
 	if err != nil {
 		return -1
 	}
 	return count
 }
 
+// CountE returns the total number of documents in the result set.
+func (q *query) CountE() (count int, err error) {
+	err = q.run(nil, func() error {
+		var err error
+		count, err = q.operator.count(q.resolved, q.skip, q.limit)
+		return q.operator.wrapError(err)
+	})
+	return count, err
+}
+
 // Distinct returns a list of distinct values for the given key within
 // the result set.  The list of distinct values will be unmarshalled
 // in the "values" key of the provided result parameter.
@@ -34,7 +117,9 @@ func (q *query) Count() int {
 //     http://www.mongodb.org/display/DOCS/Aggregation
 //
 func (q *query) Distinct(key string, result interface{}) error {
-	return q.query.Distinct(key, result)
+	return q.run(result, func() error {
+		return q.operator.wrapError(q.query.Distinct(key, result))
+	})
 }
 
 // MapReduce executes a map/reduce job for documents covered by the query.
@@ -97,7 +182,12 @@ func (q *query) Distinct(key string, result interface{}) error {
 //     http://www.mongodb.org/display/DOCS/MapReduce
 //
 func (q *query) MapReduce(job *mgo.MapReduce, result interface{}) (info *mgo.MapReduceInfo, err error) {
-	return q.query.MapReduce(job, result)
+	err = q.run(result, func() error {
+		var err error
+		info, err = q.query.MapReduce(job, result)
+		return q.operator.wrapError(err)
+	})
+	return info, err
 }
 
 // Apply runs the findAndModify MongoDB command, which allows updating, upserting
@@ -127,8 +217,40 @@ func (q *query) MapReduce(job *mgo.MapReduce, result interface{}) (info *mgo.Map
 //     http://www.mongodb.org/display/DOCS/Updating
 //     http://www.mongodb.org/display/DOCS/Atomic+Operations
 //
+// The selector is rewritten by HookRewriteDelete when change removes the
+// document, and by HookRewriteUpdate otherwise.
 func (q *query) Apply(change mgo.Change, result interface{}) (info *mgo.ChangeInfo, err error) {
-	return q.query.Apply(change, result)
+	e := &HookEvent{Operation: OperationModify, Document: result}
+	err = q.runRewrite(e, modifyRewrite(change), func() error {
+		nilInst := q.operator.repository.nilInst
+
+		if hook, is := nilInst.(HookOnModify); is {
+			err := hook.HookOnModify(q.operator.context, q.resolved, &change)
+			if err != nil {
+				return hookError("HookOnModify", err)
+			}
+		}
+
+		var err error
+		info, err = q.operator.findAndModify(q.resolved, q.sort, q.fields, change, result)
+		e.ChangeInfo = info
+		e.written = err == nil
+		if err != nil {
+			return q.operator.wrapError(err)
+		}
+
+		if hook, is := nilInst.(HookAfterModify); is {
+			err := q.operator.after(hook, "HookAfterModify", func(hook interface{}, c *handy.Context) error {
+				return hook.(HookAfterModify).HookAfterModify(c, q.resolved, info)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	return info, err
 }
 
 // Batch sets the batch size used when fetching documents from the database.
@@ -140,6 +262,9 @@ func (q *query) Apply(change mgo.Change, result interface{}) (info *mgo.ChangeIn
 // first batch, and 4MB on remaining ones.
 func (q *query) Batch(n int) *query {
 	q.query.Batch(n)
+	q.options = append(q.options, func(mq *mgo.Query) {
+		mq.Batch(n)
+	})
 	return q
 }
 
@@ -156,6 +281,9 @@ func (q *query) Batch(n int) *query {
 // The default prefetch value is 0.25.
 func (q *query) Prefetch(p float64) *query {
 	q.query.Prefetch(p)
+	q.options = append(q.options, func(mq *mgo.Query) {
+		mq.Prefetch(p)
+	})
 	return q
 }
 
@@ -163,6 +291,7 @@ func (q *query) Prefetch(p float64) *query {
 // this only makes sense with capped collections where documents are naturally
 // ordered by insertion time, or with sorted results.
 func (q *query) Skip(n int) *query {
+	q.skip = n
 	q.query.Skip(n)
 	return q
 }
@@ -186,7 +315,11 @@ func (q *query) Limit(n int) *query {
 //     http://www.mongodb.org/display/DOCS/Retrieving+a+Subset+of+Fields
 //
 func (q *query) Select(selector interface{}) *query {
+	q.fields = selector
 	q.query.Select(selector)
+	q.options = append(q.options, func(mq *mgo.Query) {
+		mq.Select(selector)
+	})
 	return q
 }
 
@@ -205,6 +338,7 @@ func (q *query) Select(selector interface{}) *query {
 //     http://www.mongodb.org/display/DOCS/Sorting+and+Natural+Order
 //
 func (q *query) Sort(fields ...string) *query {
+	q.sort = fields
 	q.query.Sort(fields...)
 	return q
 }
@@ -228,7 +362,9 @@ func (q *query) Sort(fields ...string) *query {
 //     http://www.mongodb.org/display/DOCS/Query+Optimizer
 //
 func (q *query) Explain(result interface{}) error {
-	return q.query.Explain(result)
+	return q.run(result, func() error {
+		return q.operator.wrapError(q.query.Explain(result))
+	})
 }
 
 // Hint will include an explicit "hint" in the query to force the server
@@ -248,7 +384,11 @@ func (q *query) Explain(result interface{}) error {
 //     http://www.mongodb.org/display/DOCS/Query+Optimizer
 //
 func (q *query) Hint(indexKey ...string) *query {
+	q.modifiers = true
 	q.query.Hint(indexKey...)
+	q.options = append(q.options, func(mq *mgo.Query) {
+		mq.Hint(indexKey...)
+	})
 	return q
 }
 
@@ -276,7 +416,11 @@ func (q *query) Hint(indexKey ...string) *query {
 //     http://www.mongodb.org/display/DOCS/How+to+do+Snapshotted+Queries+in+the+Mongo+Database
 //
 func (q *query) Snapshot() *query {
+	q.modifiers = true
 	q.query.Snapshot()
+	q.options = append(q.options, func(mq *mgo.Query) {
+		mq.Snapshot()
+	})
 	return q
 }
 
@@ -286,165 +430,165 @@ func (q *query) Snapshot() *query {
 // It has seen at least one use case, though, so it's exposed via the API.
 func (q *query) LogReplay() *query {
 	q.query.LogReplay()
+	q.options = append(q.options, func(mq *mgo.Query) {
+		mq.LogReplay()
+	})
 	return q
 }
 
+// modifyRewrite returns the operation whose rewrite hook applies to the
+// selector of change.
+func modifyRewrite(change mgo.Change) Operation {
+	if change.Remove {
+		return OperationDelete
+	}
+	return OperationUpdate
+}
+
+// MGOQuery returns the underlying mgo query, for running it directly.
+//
+// Deprecated: the query is rebuilt with the selector resolved by the hooks
+// every time it is run through the methods of query, which drops the
+// options set on the mgo query returned, as mgo can't tell them. Running it
+// directly also skips the search hooks and the middlewares. Set the options
+// through the methods of query instead.
 func (self *query) MGOQuery() *mgo.Query {
 	return self.query
 }
 
-func (self *query) One(target interface{}) error {
+// run executes operation as a search between the repository middlewares
+// and the search hooks of the repository type.
+func (self *query) run(result interface{}, operation func() error) error {
+	return self.runEvent(&HookEvent{Operation: OperationSearch, Document: result}, operation)
+}
+
+func (self *query) runEvent(e *HookEvent, operation func() error) error {
+	return self.runRewrite(e, OperationSearch, operation)
+}
 
-	if target, ok := target.(HookOnLoad); ok {
-		err := target.HookOnLoad(self.operator.context)
+// runRewrite executes operation as runEvent does, the selector being
+// rewritten by the hook of the rewrite operation.
+func (self *query) runRewrite(e *HookEvent, rewrite Operation, operation func() error) error {
+	e.Selector = self.selector
+	return self.operator.run(e, func() error {
+		selector, err := self.operator.rewrite(rewrite, e.Selector)
 		if err != nil {
 			return err
 		}
-	}
+		e.Selector = selector
+
+		self.resolved = selector
+		self.query = self.build(selector)
+
+		return self.operator.search(selector, operation)
+	})
+}
+
+func (self *query) One(target interface{}) error {
+	return self.run(target, func() error {
+		return self.one(target)
+	})
+}
 
-	err := self.query.One(target)
+func (self *query) one(target interface{}) error {
+	if err := self.operator.load(target); err != nil {
+		return err
+	}
 
+	var raw bson.Raw
+	err := self.operator.wrapError(self.read(self.resolved, self.sort, self.skip, self.limit).One(&raw))
 	if err != nil {
 		return err
 	}
 
-	if target, ok := target.(HookAfterLoad); ok {
-		target.HookAfterLoad(self.operator.context)
+	if err := self.operator.unmarshal(&raw, target); err != nil {
+		return err
 	}
 
-	return nil
+	return self.operator.populate(target, self.populate)
 }
 
 
 func (self *query) All(target interface{}) error {
-	iter := self.query.Iter()
-	defer func() {
-		//Make sure to close the iterator
-		if err := recover(); err != nil {
-			iter.Close()
-		}
-	}()
+	return self.run(target, func() error {
+		return self.all(target)
+	})
+}
 
+func (self *query) all(target interface{}) error {
 	resultv := reflect.ValueOf(target)
 
 	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
 		panic("result argument must be a slice address")
 	}
 
-	slicev := resultv.Elem()
-	slicev = slicev.Slice(0, slicev.Cap())
-	elemt := slicev.Type().Elem()
-	i := 0
-
-	for {
-		if slicev.Len() == i {
-			elemp := reflect.New(elemt)
-			newElement := elemp.Interface()
-
-			if newElement, ok := newElement.(HookOnLoad); ok {
-				err := newElement.HookOnLoad(self.operator.context)
-				if err != nil {
-					return err
-				}
-			}
-
-			if !iter.Next(newElement) {
-				break
-			}
-
-			if newElement, ok := newElement.(HookAfterLoad); ok {
-				newElement.HookAfterLoad(self.operator.context)
-			}
-
-			slicev = reflect.Append(slicev, elemp.Elem())
-			slicev = slicev.Slice(0, slicev.Cap())
+	iter := self.read(self.resolved, self.sort, self.skip, self.limit).Iter()
+	next := func(raw *bson.Raw) bool {
+		return iter.Next(raw)
+	}
 
-		} else {
-			element := slicev.Index(i).Addr().Interface()
+	slicev, err := self.operator.decodeAll(next, iter.Close, resultv.Elem(), self.collectErrors)
+	if !slicev.IsValid() {
+		return err
+	}
 
-			if element, ok := element.(HookOnLoad); ok {
-				err := element.HookOnLoad(self.operator.context)
-				if err != nil {
-					return err
-				}
-			}
+	resultv.Elem().Set(slicev)
 
-			if !iter.Next(element) {
-				break
-			}
-
-			if element, ok := element.(HookAfterLoad); ok {
-				element.HookAfterLoad(self.operator.context)
-			}
-		}
-		i++
+	if err := self.operator.populate(target, self.populate); err != nil {
+		return err
 	}
 
-	return iter.Close()
+	return err
 }
 
+// GetOne returns the first document of the result set as a pointer to the
+// repository type, or nil on any error. The failures to populate are
+// logged. See GetOneE.
 func (self *query) GetOne() interface{} {
+	m, err := self.GetOneE()
+	logPopulateError(err)
+	return m
+}
+
+// GetOneE returns the first document of the result set as a pointer to the
+// repository type. It returns ErrNotFound when the result set is empty.
+func (self *query) GetOneE() (interface{}, error) {
 	m := reflect.New(self.operator.repository.typE).Interface()
 	err := self.One(m)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	return m
+	return m, nil
 }
 
-
-
+// GetAll returns the result set as a slice of the repository type, or nil on
+// any error. The failures to populate are logged. See GetAllE.
 func (self *query) GetAll() interface{} {
-	iter := self.query.Iter()
-	defer iter.Close()
-
-	slicev := reflect.MakeSlice(reflect.SliceOf(self.operator.repository.typE), self.limit, self.limit)
-	elemt := slicev.Type().Elem()
-	i := 0
-
-	for {
-		if slicev.Len() == i {
-			elemp := reflect.New(elemt)
-			newElement := elemp.Interface()
-
-			if newElement, ok := newElement.(HookOnLoad); ok {
-				err := newElement.HookOnLoad(self.operator.context)
-				if err != nil {
-					return nil
-				}
-			}
-
-			if !iter.Next(newElement) {
-				break
-			}
-
-			if newElement, ok := newElement.(HookAfterLoad); ok {
-				newElement.HookAfterLoad(self.operator.context)
-			}
-
-			slicev = reflect.Append(slicev, elemp.Elem())
-			slicev = slicev.Slice(0, slicev.Cap())
-
-		} else {
-			element := slicev.Index(i).Addr().Interface()
-
-			if element, ok := element.(HookOnLoad); ok {
-				err := element.HookOnLoad(self.operator.context)
-				if err != nil {
-					return nil
-				}
-			}
-
-			if !iter.Next(element) {
-				break
-			}
+	items, err := self.GetAllE()
+	logPopulateError(err)
+	return items
+}
 
-			if element, ok := element.(HookAfterLoad); ok {
-				element.HookAfterLoad(self.operator.context)
-			}
-		}
-		i++
+// logPopulateError logs err when it's a PopulateError, which the callers
+// of GetAll and GetOne don't get.
+func logPopulateError(err error) {
+	var populateErr *PopulateError
+	if errors.As(err, &populateErr) {
+		log.Print(populateErr)
 	}
+}
 
-	return slicev.Interface()
+// GetAllE returns the result set as a slice of the repository type. Errors
+// returned by the load hooks are wrapped in a HookError, and the iterator is
+// closed and its error returned in any case. With CollectHookErrors the
+// slice is returned along with the HookErrors.
+func (self *query) GetAllE() (items interface{}, err error) {
+	e := &HookEvent{Operation: OperationSearch}
+	err = self.runEvent(e, func() error {
+		var err error
+		items, err = self.collect(self.read(self.resolved, self.sort, self.skip, self.limit).Iter(), self.limit)
+		e.Document = items
+		return err
+	})
+	return items, err
 }
@@ -0,0 +1,117 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"github.com/go4r/handy"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+)
+
+var errApplyTestStop = errors.New("stop before the write")
+
+type applyTestDocument struct {
+	Id bson.ObjectId `bson:"_id"`
+}
+
+func (*applyTestDocument) HookRewriteSearch(c *handy.Context, selector interface{}) (interface{}, error) {
+	return bson.M{"rewrite": "search"}, nil
+}
+
+func (*applyTestDocument) HookRewriteUpdate(c *handy.Context, selector interface{}) (interface{}, error) {
+	return bson.M{"rewrite": "update"}, nil
+}
+
+func (*applyTestDocument) HookRewriteDelete(c *handy.Context, selector interface{}) (interface{}, error) {
+	return bson.M{"rewrite": "delete"}, nil
+}
+
+func (*applyTestDocument) HookOnModify(c *handy.Context, selector interface{}, change *mgo.Change) error {
+	return errApplyTestStop
+}
+
+// testOperator returns an operator of a repository of the type of nilInst
+// which sends nothing to a server.
+func testOperator(nilInst interface{}) *repositoryOperator {
+	repository := &repository{collection: "tests", typE: reflect.TypeOf(nilInst).Elem(), nilInst: nilInst}
+	collection := &mgo.Collection{Database: &mgo.Database{Session: &mgo.Session{}, Name: "test"}, Name: "tests", FullName: "test.tests"}
+	return &repositoryOperator{repository: repository, collection: collection, ctx: context.Background()}
+}
+
+func TestApplyRewrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		change mgo.Change
+		want   string
+	}{
+		{"update", mgo.Change{Update: bson.M{"$inc": bson.M{"n": 1}}}, "update"},
+		{"upsert", mgo.Change{Update: bson.M{"$inc": bson.M{"n": 1}}, Upsert: true}, "update"},
+		{"remove", mgo.Change{Remove: true}, "delete"},
+	}
+
+	for _, test := range tests {
+		q := testOperator(&applyTestDocument{}).Search(bson.M{"_id": bson.NewObjectId()})
+		_, err := q.Apply(test.change, &applyTestDocument{})
+		if !errors.Is(err, errApplyTestStop) {
+			t.Errorf("%s: error %v, want the HookOnModify error", test.name, err)
+			continue
+		}
+		if want := (bson.M{"rewrite": test.want}); !reflect.DeepEqual(q.resolved, want) {
+			t.Errorf("%s: selector %v, want %v", test.name, q.resolved, want)
+		}
+	}
+}
+
+type decodeTestDocument struct {
+	Name string `bson:"name"`
+}
+
+var decodeTestLoads int
+
+func (*decodeTestDocument) HookOnLoad(c *handy.Context) error {
+	if decodeTestLoads++; decodeTestLoads == 2 {
+		return errors.New("load failed")
+	}
+	return nil
+}
+
+func TestDecodeAllReusesElements(t *testing.T) {
+	var docs []bson.Raw
+	for _, name := range []string{"a", "b", "c"} {
+		data, err := bson.Marshal(bson.M{"name": name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, bson.Raw{Kind: 0x03, Data: data})
+	}
+	next := func(raw *bson.Raw) bool {
+		if len(docs) == 0 {
+			return false
+		}
+		*raw, docs = docs[0], docs[1:]
+		return true
+	}
+
+	// The load hook fails on the second document, which is left out, the
+	// third one going in its place.
+	target := make([]decodeTestDocument, 1, 4)
+	target[0].Name = "old"
+	first := &target[0]
+
+	decodeTestLoads = 0
+	operator := testOperator(&decodeTestDocument{})
+	slicev, err := operator.decodeAll(next, func() error { return nil }, reflect.ValueOf(target), true)
+	if !errors.Is(err, ErrHookAborted) {
+		t.Fatalf("error %v, want the HookError of the second document", err)
+	}
+
+	result := slicev.Interface().([]decodeTestDocument)
+	if len(result) != 2 || result[0].Name != "a" || result[1].Name != "c" {
+		t.Fatalf("decoded %v, want a and c", result)
+	}
+	if &result[0] != first {
+		t.Fatal("the elements of the target slice aren't decoded into")
+	}
+}
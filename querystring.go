@@ -0,0 +1,384 @@
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidQuery is matched by the errors returned by QueryParser.Parse.
+var ErrInvalidQuery = errors.New("mongo: invalid query parameter")
+
+// queryOperators maps the suffixes of the filter parameters to the
+// operator they translate to.
+var queryOperators = map[string]string{
+	"ne":         "$ne",
+	"gt":         "$gt",
+	"gte":        "$gte",
+	"lt":         "$lt",
+	"lte":        "$lte",
+	"in":         "$in",
+	"nin":        "$nin",
+	"exists":     "$exists",
+	"contains":   "$regex",
+	"startswith": "$regex",
+}
+
+// QueryParser translates URL query parameters into the selector, sort,
+// skip, limit and selected fields of a query. Only the fields of the
+// document type may be used, but the ones hidden from the JSON encoding
+// with a json:"-" tag, and the values are converted to the type of their
+// field, so that no operator can be smuggled into the selector.
+//
+// A parameter named after a field filters on equality, and a suffix picks
+// another comparison: __ne, __gt, __gte, __lt, __lte, __in and __nin
+// taking comma separated values, __exists taking a boolean, __contains
+// and __startswith matching strings literally. Fields of nested structs
+// are named by their dotted path. The sort, skip, limit and fields
+// parameters set the sort order ("-" prefixed fields are descending), the
+// documents skipped, the documents returned and the fields selected:
+//
+//     GET /users?age__gt=30&status__in=active,invited&sort=-created&limit=20
+//
+//     parsed, err := mongo.NewQueryParser(&User{}).Parse(r.URL.Query())
+//     if err != nil {
+//             http.Error(w, err.Error(), http.StatusBadRequest)
+//             return
+//     }
+//     users := parsed.Search(Users(r)).GetAll()
+//
+type QueryParser struct {
+	// MaxLimit bounds the limit parameter, and is the limit applied when
+	// it's missing. Zero means no bound.
+	MaxLimit int
+
+	fields map[string]reflect.Type
+}
+
+// ParsedQuery is the outcome of QueryParser.Parse.
+type ParsedQuery struct {
+	Selector bson.M
+	Sort     []string
+	Skip     int
+	Limit    int
+	Select   bson.M
+}
+
+var (
+	queryFieldsMutex sync.RWMutex
+	queryFieldsCache = map[reflect.Type]map[string]reflect.Type{}
+)
+
+// NewQueryParser returns the parser of the queries on the documents of the
+// type of nilInst, restricted to fields when given.
+func NewQueryParser(nilInst interface{}, fields ...string) *QueryParser {
+	all := queryFields(reflect.TypeOf(nilInst))
+	if len(fields) == 0 {
+		return &QueryParser{fields: all}
+	}
+
+	allowed := map[string]reflect.Type{}
+	for _, name := range fields {
+		if typ, ok := all[name]; ok {
+			allowed[name] = typ
+		}
+	}
+	return &QueryParser{fields: allowed}
+}
+
+// queryFields returns the type of the fields of typ by their dotted path.
+func queryFields(typ reflect.Type) map[string]reflect.Type {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	queryFieldsMutex.RLock()
+	fields, ok := queryFieldsCache[typ]
+	queryFieldsMutex.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = map[string]reflect.Type{}
+	if typ.Kind() == reflect.Struct {
+		collectQueryFields(typ, "", fields, map[reflect.Type]bool{})
+	}
+
+	queryFieldsMutex.Lock()
+	queryFieldsCache[typ] = fields
+	queryFieldsMutex.Unlock()
+	return fields
+}
+
+func collectQueryFields(typ reflect.Type, prefix string, fields map[string]reflect.Type, visiting map[reflect.Type]bool) {
+	if visiting[typ] {
+		return
+	}
+	visiting[typ] = true
+	defer delete(visiting, typ)
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		// The fields hidden from the clients, such as password hashes,
+		// can't be guessed by filtering on them either.
+		if field.Tag.Get("json") == "-" {
+			continue
+		}
+
+		name, inline := bsonFieldName(field)
+		if inline && field.Type.Kind() == reflect.Struct {
+			collectQueryFields(field.Type, prefix, fields, visiting)
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+
+		path := prefix + name
+		fields[path] = field.Type
+
+		nested := field.Type
+		if nested.Kind() == reflect.Ptr {
+			nested = nested.Elem()
+		}
+		if nested.Kind() == reflect.Struct && nested != timeType {
+			collectQueryFields(nested, path+".", fields, visiting)
+		}
+	}
+}
+
+// Parse translates values, failing with an error matching ErrInvalidQuery
+// on unknown fields, operators or malformed values.
+func (p *QueryParser) Parse(values url.Values) (*ParsedQuery, error) {
+	parsed := &ParsedQuery{Selector: bson.M{}, Limit: p.MaxLimit}
+
+	for param, vals := range values {
+		value := vals[0]
+
+		switch param {
+		case "sort":
+			for _, key := range strings.Split(value, ",") {
+				if _, ok := p.fields[strings.TrimPrefix(key, "-")]; !ok {
+					return nil, invalidQuery(param, "unknown field %q", key)
+				}
+				parsed.Sort = append(parsed.Sort, key)
+			}
+		case "fields":
+			parsed.Select = bson.M{}
+			for _, name := range strings.Split(value, ",") {
+				if _, ok := p.fields[name]; !ok {
+					return nil, invalidQuery(param, "unknown field %q", name)
+				}
+				parsed.Select[name] = 1
+			}
+		case "skip":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, invalidQuery(param, "must be a positive integer")
+			}
+			parsed.Skip = n
+		case "limit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, invalidQuery(param, "must be a positive integer")
+			}
+			if p.MaxLimit > 0 && n > p.MaxLimit {
+				n = p.MaxLimit
+			}
+			parsed.Limit = n
+		default:
+			if err := p.filter(parsed.Selector, param, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return parsed, nil
+}
+
+// filter adds the condition of the filter parameter param to selector.
+func (p *QueryParser) filter(selector bson.M, param, value string) error {
+	name, suffix := param, ""
+	if i := strings.LastIndex(param, "__"); i >= 0 {
+		if _, ok := queryOperators[param[i+2:]]; ok {
+			name, suffix = param[:i], param[i+2:]
+		}
+	}
+
+	typ, ok := p.fields[name]
+	if !ok {
+		return invalidQuery(param, "unknown field %q", name)
+	}
+
+	// Conditions on arrays apply to their elements.
+	if typ.Kind() == reflect.Slice && typ.Elem().Kind() != reflect.Uint8 {
+		typ = typ.Elem()
+	}
+
+	var condition interface{}
+
+	switch suffix {
+	case "":
+		v, err := parseValue(typ, value)
+		if err != nil {
+			return invalidQuery(param, "%v", err)
+		}
+		if _, exists := selector[name]; exists {
+			return invalidQuery(param, "conflicting conditions on %q", name)
+		}
+		selector[name] = v.Interface()
+		return nil
+	case "in", "nin":
+		var list []interface{}
+		for _, item := range strings.Split(value, ",") {
+			v, err := parseValue(typ, item)
+			if err != nil {
+				return invalidQuery(param, "%v", err)
+			}
+			list = append(list, v.Interface())
+		}
+		condition = list
+	case "exists":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return invalidQuery(param, "%v", err)
+		}
+		condition = b
+	case "contains", "startswith":
+		if typ.Kind() != reflect.String {
+			return invalidQuery(param, "%q isn't a string field", name)
+		}
+		pattern := regexp.QuoteMeta(value)
+		if suffix == "startswith" {
+			pattern = "^" + pattern
+		}
+		condition = bson.RegEx{Pattern: pattern}
+	default:
+		v, err := parseValue(typ, value)
+		if err != nil {
+			return invalidQuery(param, "%v", err)
+		}
+		condition = v.Interface()
+	}
+
+	conditions, ok := selector[name].(bson.M)
+	if !ok {
+		if _, exists := selector[name]; exists {
+			return invalidQuery(param, "conflicting conditions on %q", name)
+		}
+		conditions = bson.M{}
+		selector[name] = conditions
+	}
+
+	operator := queryOperators[suffix]
+	if _, exists := conditions[operator]; exists {
+		return invalidQuery(param, "conflicting conditions on %q", name)
+	}
+	conditions[operator] = condition
+	return nil
+}
+
+func invalidQuery(param, format string, args ...interface{}) error {
+	return fmt.Errorf("%w %q: %s", ErrInvalidQuery, param, fmt.Sprintf(format, args...))
+}
+
+// Search returns the query of operator matching the parsed parameters.
+func (parsed *ParsedQuery) Search(operator *repositoryOperator) *query {
+	q := operator.Search(parsed.Selector)
+	if len(parsed.Sort) > 0 {
+		q.Sort(parsed.Sort...)
+	}
+	if parsed.Skip > 0 {
+		q.Skip(parsed.Skip)
+	}
+	if parsed.Limit > 0 {
+		q.Limit(parsed.Limit)
+	}
+	if parsed.Select != nil {
+		q.Select(parsed.Select)
+	}
+	return q
+}
+
+var (
+	objectIdType = reflect.TypeOf(bson.ObjectId(""))
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// parseValue converts the query string value s to typ.
+func parseValue(typ reflect.Type, s string) (reflect.Value, error) {
+	value := reflect.New(typ).Elem()
+
+	switch {
+	case typ == objectIdType:
+		if !bson.IsObjectIdHex(s) {
+			return value, fmt.Errorf("mongo: invalid ObjectId %q", s)
+		}
+		value.Set(reflect.ValueOf(bson.ObjectIdHex(s)))
+		return value, nil
+	case typ == timeType:
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return value, err
+		}
+		value.Set(reflect.ValueOf(t))
+		return value, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Ptr:
+		elem, err := parseValue(typ.Elem(), s)
+		if err != nil {
+			return value, err
+		}
+		value.Set(reflect.New(typ.Elem()))
+		value.Elem().Set(elem)
+	case reflect.String:
+		value.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return value, err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, typ.Bits())
+		if err != nil {
+			return value, err
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, typ.Bits())
+		if err != nil {
+			return value, err
+		}
+		value.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, typ.Bits())
+		if err != nil {
+			return value, err
+		}
+		value.SetFloat(f)
+	case reflect.Interface:
+		if bson.IsObjectIdHex(s) {
+			value.Set(reflect.ValueOf(bson.ObjectIdHex(s)))
+		} else {
+			value.Set(reflect.ValueOf(s))
+		}
+	default:
+		return value, fmt.Errorf("mongo: can't filter on values of type %s", typ)
+	}
+
+	return value, nil
+}
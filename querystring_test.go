@@ -0,0 +1,142 @@
+package mongo
+
+import (
+	"errors"
+	"labix.org/v2/mgo/bson"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type queryTestProfile struct {
+	City string `bson:"city"`
+}
+
+type queryTestDocument struct {
+	Id       bson.ObjectId    `bson:"_id" json:"id"`
+	Name     string           `bson:"name" json:"name"`
+	Age      int              `bson:"age" json:"age"`
+	Score    float64          `bson:"score" json:"score"`
+	Active   bool             `bson:"active" json:"active"`
+	Created  time.Time        `bson:"created" json:"created"`
+	Tags     []string         `bson:"tags" json:"tags"`
+	Profile  queryTestProfile `bson:"profile" json:"profile"`
+	Password string           `bson:"password" json:"-"`
+	Secret   queryTestProfile `bson:"secret" json:"-"`
+	Ignored  string           `bson:"-"`
+}
+
+func TestQueryParserParse(t *testing.T) {
+	id := bson.NewObjectId()
+	created := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query string
+		want  bson.M
+	}{
+		{"equality", "name=bob", bson.M{"name": "bob"}},
+		{"integer", "age=30", bson.M{"age": 30}},
+		{"float", "score__gte=1.5", bson.M{"score": bson.M{"$gte": 1.5}}},
+		{"boolean", "active=true", bson.M{"active": true}},
+		{"ObjectId", "_id=" + id.Hex(), bson.M{"_id": id}},
+		{"time", "created__lt=2024-05-01T10:00:00Z", bson.M{"created": bson.M{"$lt": created}}},
+		{"range", "age__gt=18&age__lte=65", bson.M{"age": bson.M{"$gt": 18, "$lte": 65}}},
+		{"not equal", "name__ne=bob", bson.M{"name": bson.M{"$ne": "bob"}}},
+		{"in", "age__in=1,2,3", bson.M{"age": bson.M{"$in": []interface{}{1, 2, 3}}}},
+		{"not in", "name__nin=a,b", bson.M{"name": bson.M{"$nin": []interface{}{"a", "b"}}}},
+		{"exists", "name__exists=false", bson.M{"name": bson.M{"$exists": false}}},
+		{"contains quoted", "name__contains=a.b", bson.M{"name": bson.M{"$regex": bson.RegEx{Pattern: `a\.b`}}}},
+		{"startswith", "name__startswith=bo", bson.M{"name": bson.M{"$regex": bson.RegEx{Pattern: "^bo"}}}},
+		{"array element", "tags=go", bson.M{"tags": "go"}},
+		{"nested field", "profile.city=Paris", bson.M{"profile.city": "Paris"}},
+		{"operator lookalike kept as a string", "name=$gt", bson.M{"name": "$gt"}},
+	}
+
+	parser := NewQueryParser(&queryTestDocument{})
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		parsed, err := parser.Parse(values)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed.Selector, test.want) {
+			t.Errorf("%s: selector %#v, want %#v", test.name, parsed.Selector, test.want)
+		}
+	}
+}
+
+func TestQueryParserOptions(t *testing.T) {
+	parser := NewQueryParser(&queryTestDocument{})
+	parser.MaxLimit = 50
+
+	values, _ := url.ParseQuery("sort=-age,name&skip=10&limit=100&fields=name,age")
+	parsed, err := parser.Parse(values)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if want := []string{"-age", "name"}; !reflect.DeepEqual(parsed.Sort, want) {
+		t.Errorf("sort %v, want %v", parsed.Sort, want)
+	}
+	if parsed.Skip != 10 {
+		t.Errorf("skip %d, want 10", parsed.Skip)
+	}
+	if parsed.Limit != 50 {
+		t.Errorf("limit %d, want the MaxLimit 50", parsed.Limit)
+	}
+	if want := (bson.M{"name": 1, "age": 1}); !reflect.DeepEqual(parsed.Select, want) {
+		t.Errorf("select %v, want %v", parsed.Select, want)
+	}
+}
+
+func TestQueryParserInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"unknown field", "missing=1"},
+		{"hidden field", "password__startswith=a"},
+		{"field of a hidden struct", "secret.city=Paris"},
+		{"bson ignored field", "Ignored=x"},
+		{"unknown operator", "age__regex=1"},
+		{"operator as field", "$where=1"},
+		{"malformed integer", "age=thirty"},
+		{"integer list", "age__in=1,two"},
+		{"malformed ObjectId", "_id=123"},
+		{"malformed time", "created=yesterday"},
+		{"malformed boolean", "name__exists=maybe"},
+		{"regex on a number", "age__contains=1"},
+		{"conflicting conditions", "age=1&age__gt=2"},
+		{"sort on hidden field", "sort=password"},
+		{"select hidden field", "fields=password"},
+		{"negative skip", "skip=-1"},
+		{"null limit", "limit=0"},
+	}
+
+	parser := NewQueryParser(&queryTestDocument{})
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		if _, err := parser.Parse(values); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: error %v, want ErrInvalidQuery", test.name, err)
+		}
+	}
+}
+
+func TestQueryParserFields(t *testing.T) {
+	parser := NewQueryParser(&queryTestDocument{}, "name", "password")
+
+	values, _ := url.ParseQuery("name=bob")
+	if _, err := parser.Parse(values); err != nil {
+		t.Errorf("allowed field: unexpected error %v", err)
+	}
+
+	for _, query := range []string{"age=1", "password=x"} {
+		values, _ := url.ParseQuery(query)
+		if _, err := parser.Parse(values); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: error %v, want ErrInvalidQuery", query, err)
+		}
+	}
+}
@@ -0,0 +1,463 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueEmpty is returned by Claim when no job is available.
+	ErrQueueEmpty = errors.New("mongo: no job available in the queue")
+
+	// ErrLeaseLost is returned when a job is settled after its visibility
+	// timeout expired, the job being then available to other workers or
+	// already claimed by one of them.
+	ErrLeaseLost = errors.New("mongo: the lease of the job expired")
+)
+
+// Job is a message of a Queue. Lease identifies the claim of the job, and
+// Available is the time it becomes visible to Claim: once its delay
+// elapsed when it's waiting, and once its visibility timeout expired when
+// it's claimed.
+type Job struct {
+	Id          bson.ObjectId `bson:"_id"`
+	Payload     bson.Raw      `bson:"payload"`
+	Priority    int           `bson:"priority"`
+	Available   time.Time     `bson:"available"`
+	Created     time.Time     `bson:"created"`
+	Attempts    int           `bson:"attempts"`
+	MaxAttempts int           `bson:"maxAttempts"`
+	Lease       bson.ObjectId `bson:"lease,omitempty"`
+	LastError   string        `bson:"lastError,omitempty"`
+	Failed      time.Time     `bson:"failed,omitempty"`
+}
+
+// Decode unmarshals the payload of the job into v.
+func (job *Job) Decode(v interface{}) error {
+	return job.Payload.Unmarshal(v)
+}
+
+// Queue is a persistent job queue stored in a collection, whose jobs are
+// claimed atomically with findAndModify, highest priority first and then
+// oldest first:
+//
+//     var Emails = mongo.NewQueue("emails")
+//
+//     job, err := Emails.Operator(r).Enqueue(&Email{To: user.Email}, 0, 10*time.Minute)
+//
+// A claimed job is invisible to the other workers for the Visibility
+// timeout, after which it's claimed again unless it was acknowledged, so
+// jobs are handled at least once. A job failing, or whose worker died, is
+// retried after Backoff until it ran MaxAttempts times, and is then moved
+// to the dead-letter collection, from which Requeue brings it back.
+//
+// The operations go through a repository of the queue collection, so the
+// middlewares apply, and the changes of the jobs are published to Events.
+type Queue struct {
+	// Visibility is the time a claimed job stays invisible to the other
+	// workers, see Extend.
+	Visibility time.Duration
+	// MaxAttempts is the number of attempts of the jobs enqueued, zero for
+	// no limit.
+	MaxAttempts int
+	// Backoff returns the delay before a job which failed attempts times
+	// is available again.
+	Backoff func(attempts int) time.Duration
+
+	jobs *repository
+	dead *repository
+}
+
+// NewQueue returns the queue stored in collection, whose dead letters are
+// stored in collection+".dead".
+func NewQueue(collection string) *Queue {
+	typ := reflect.TypeOf(Job{})
+	return &Queue{
+		Visibility:  5 * time.Minute,
+		MaxAttempts: 5,
+		Backoff:     ExponentialBackoff(time.Second, time.Hour),
+		jobs:        &repository{collection: collection, typE: typ, nilInst: &Job{}},
+		dead:        &repository{collection: collection + ".dead", typE: typ, nilInst: &Job{}},
+	}
+}
+
+// ExponentialBackoff returns the backoff doubling base on every attempt,
+// up to max.
+func ExponentialBackoff(base, max time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		delay := base
+		for i := 1; i < attempts && delay < max; i++ {
+			delay *= 2
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// Operator returns the operator of the queue for the request rc.
+func (q *Queue) Operator(rc interface{}) *queueOperator {
+	c := cContext(rc)
+	return &queueOperator{queue: q, jobs: q.jobs.operator(c), dead: q.dead.operator(c)}
+}
+
+// SessionOperator returns the operator of the queue for background work,
+// on the database of session and bound to ctx, with no handy context.
+func (q *Queue) SessionOperator(ctx context.Context, session *mgo.Session, database string) *queueOperator {
+	db := session.DB(database)
+	return &queueOperator{
+		queue: q,
+		jobs:  &repositoryOperator{repository: q.jobs, collection: db.C(q.jobs.collection), ctx: ctx},
+		dead:  &repositoryOperator{repository: q.dead, collection: db.C(q.dead.collection), ctx: ctx},
+	}
+}
+
+type queueOperator struct {
+	queue *Queue
+	jobs  *repositoryOperator
+	dead  *repositoryOperator
+}
+
+// EnsureIndexes creates the index the claims run on.
+func (self *queueOperator) EnsureIndexes() error {
+	return self.jobs.wrapError(self.jobs.collection.EnsureIndexKey("-priority", "available"))
+}
+
+// Enqueue adds a job carrying payload, a document, available once delay
+// elapsed. The jobs of higher priority are claimed first.
+func (self *queueOperator) Enqueue(payload interface{}, priority int, delay time.Duration) (*Job, error) {
+	data, err := bson.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		Id:          bson.NewObjectId(),
+		Payload:     bson.Raw{Kind: 0x03, Data: data},
+		Priority:    priority,
+		Available:   now.Add(delay),
+		Created:     now,
+		MaxAttempts: self.queue.MaxAttempts,
+	}
+
+	if err := self.jobs.Insert(job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Claim reserves the next available job for the Visibility timeout. It
+// returns ErrQueueEmpty when there's none. The jobs which already ran
+// MaxAttempts times, their last worker having died, are moved to the
+// dead-letter collection instead.
+func (self *queueOperator) Claim() (*Job, error) {
+	for {
+		now := time.Now()
+		change := mgo.Change{
+			Update: bson.M{
+				"$set": bson.M{"available": now.Add(self.queue.Visibility), "lease": bson.NewObjectId()},
+				"$inc": bson.M{"attempts": 1},
+			},
+			ReturnNew: true,
+		}
+
+		job := &Job{}
+		_, err := self.jobs.Search(bson.M{"available": bson.M{"$lte": now}}).Sort("-priority", "available").Apply(change, job)
+		if err == ErrNotFound {
+			return nil, ErrQueueEmpty
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if job.MaxAttempts > 0 && job.Attempts > job.MaxAttempts {
+			job.Attempts--
+			if err := self.bury(job, "the visibility timeout expired"); err != nil && err != ErrLeaseLost {
+				return nil, err
+			}
+			continue
+		}
+
+		return job, nil
+	}
+}
+
+// Extend keeps the claimed job invisible for d from now, for the jobs
+// running longer than the Visibility timeout.
+func (self *queueOperator) Extend(job *Job, d time.Duration) error {
+	available := time.Now().Add(d)
+	err := self.settle(self.jobs.Update(job.lease(), bson.M{"$set": bson.M{"available": available}}))
+	if err == nil {
+		job.Available = available
+	}
+	return err
+}
+
+// Ack removes the claimed job, once handled.
+func (self *queueOperator) Ack(job *Job) error {
+	return self.settle(self.jobs.Delete(job.lease()))
+}
+
+// Nack releases the claimed job, which failed with cause. It's retried
+// after Backoff, or moved to the dead-letter collection when it ran
+// MaxAttempts times.
+func (self *queueOperator) Nack(job *Job, cause error) error {
+	if job.MaxAttempts > 0 && job.Attempts >= job.MaxAttempts {
+		return self.bury(job, cause.Error())
+	}
+
+	update := bson.M{
+		"$set":   bson.M{"available": time.Now().Add(self.queue.Backoff(job.Attempts)), "lastError": cause.Error()},
+		"$unset": bson.M{"lease": 1},
+	}
+	return self.settle(self.jobs.Update(job.lease(), update))
+}
+
+// bury moves the claimed job to the dead-letter collection.
+func (self *queueOperator) bury(job *Job, cause string) error {
+	// The dead letter keeps the lease of the claim burying it.
+	dead := *job
+	dead.LastError = cause
+	dead.Failed = time.Now()
+
+	// The dead letter keeps the id of the job, so that burying it again
+	// after a failure is harmless.
+	inserted := true
+	if err := self.dead.Insert(&dead); errors.Is(err, ErrDuplicateKey) {
+		inserted = false
+	} else if err != nil {
+		return err
+	}
+
+	// The dead letter is withdrawn when the job went to another worker,
+	// provided it's the one this call inserted.
+	err := self.settle(self.jobs.Delete(job.lease()))
+	if err == ErrLeaseLost && inserted {
+		if err := self.dead.Delete(job.lease()); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return err
+}
+
+// settle maps the failure of a write on the lease of a job.
+func (self *queueOperator) settle(err error) error {
+	if err == ErrNotFound {
+		return ErrLeaseLost
+	}
+	return err
+}
+
+// lease returns the selector of the job as long as its claim holds.
+func (job *Job) lease() bson.M {
+	return bson.M{"_id": job.Id, "lease": job.Lease}
+}
+
+// DeadLetters returns the query of the jobs of the dead-letter collection.
+func (self *queueOperator) DeadLetters(selector interface{}) *query {
+	return self.dead.Search(selector)
+}
+
+// Requeue moves the dead letter with the given id back to the queue, with
+// its attempts reset.
+func (self *queueOperator) Requeue(id bson.ObjectId) error {
+	job := &Job{}
+	if err := self.dead.Search(bson.M{"_id": id}).One(job); err != nil {
+		return err
+	}
+
+	job.Attempts = 0
+	job.Available = time.Now()
+	job.Failed = time.Time{}
+	job.Lease = ""
+
+	if err := self.jobs.Insert(job); err != nil && !errors.Is(err, ErrDuplicateKey) {
+		return err
+	}
+	return self.dead.Delete(bson.M{"_id": id})
+}
+
+// Worker handles the jobs of a Queue, up to Concurrency at once:
+//
+//     worker := mongo.NewWorker(Emails, mongo.MongoSession, func(ctx context.Context, job *mongo.Job) error {
+//             email := &Email{}
+//             if err := job.Decode(email); err != nil {
+//                     return err
+//             }
+//             return send(ctx, email)
+//     })
+//     worker.Concurrency = 8
+//     go worker.Run(ctx)
+//
+// A job is acknowledged when Handler returns nil, and released for a retry
+// otherwise, a panic counting as a failure. Its claim is extended while
+// Handler runs, so the Visibility timeout only bounds the time a job stays
+// claimed by a dead worker.
+type Worker struct {
+	Queue    *Queue
+	Session  *mgo.Session
+	Database string
+	Handler  func(ctx context.Context, job *Job) error
+
+	// Concurrency is the number of jobs handled at once, at least 1.
+	Concurrency int
+	// Interval is the pause between two polls of an empty queue. The
+	// polls failing on the connection are retried after a pause doubling
+	// from Interval up to a minute.
+	Interval time.Duration
+
+	// OnError receives the errors of the acknowledgments and releases of
+	// the jobs handled, ErrLeaseLost among them. They are logged when it's
+	// nil.
+	OnError func(job *Job, err error)
+}
+
+func NewWorker(queue *Queue, session *mgo.Session, handler func(ctx context.Context, job *Job) error) *Worker {
+	return &Worker{
+		Queue:       queue,
+		Session:     session,
+		Database:    MongoDBName,
+		Handler:     handler,
+		Concurrency: 1,
+		Interval:    time.Second,
+	}
+}
+
+// Run handles the jobs until ctx is done, and then waits for the jobs
+// running, whose context is done as well, to be settled. It returns early
+// on the errors of Claim other than the connection failures.
+func (w *Worker) Run(ctx context.Context) error {
+	session := w.Session.Copy()
+	defer session.Close()
+
+	operator := w.Queue.SessionOperator(ctx, session, w.Database)
+
+	concurrency := w.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+
+	base := w.Interval
+	if base <= 0 {
+		base = time.Second
+	}
+	backoff := ExponentialBackoff(base, time.Minute)
+	failures := 0
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case slots <- struct{}{}:
+		}
+
+		job, err := operator.Claim()
+		if err != nil {
+			<-slots
+
+			pause := w.Interval
+			switch {
+			case err == ErrQueueEmpty || err == ctx.Err():
+				failures = 0
+			case isTransient(err):
+				failures++
+				pause = backoff(failures)
+				session.Refresh()
+			default:
+				return err
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pause):
+			}
+			continue
+		}
+		failures = 0
+
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			defer func() { <-slots }()
+			w.handle(ctx, job)
+		}()
+	}
+}
+
+// handle runs Handler on job and settles it. The job is settled even when
+// ctx is done, so that it's retried after its backoff rather than once its
+// claim expired. The context of Handler is canceled when the claim is lost
+// to another worker.
+func (w *Worker) handle(ctx context.Context, job *Job) {
+	session := w.Session.Copy()
+	defer session.Close()
+
+	operator := w.Queue.SessionOperator(context.Background(), session, w.Database)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	defer close(done)
+	if interval := w.Queue.Visibility / 2; interval > 0 {
+		// The claim is extended on a copy of the job, which Handler
+		// may be reading.
+		lease := *job
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					if operator.Extend(&lease, w.Queue.Visibility) == ErrLeaseLost {
+						cancel()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var err error
+	if handlerErr := w.run(ctx, job); handlerErr != nil {
+		err = operator.Nack(job, handlerErr)
+	} else {
+		err = operator.Ack(job)
+	}
+	if err != nil {
+		w.reportError(job, err)
+	}
+}
+
+func (w *Worker) reportError(job *Job, err error) {
+	if w.OnError != nil {
+		w.OnError(job, err)
+		return
+	}
+	log.Printf("mongo: settling job %s failed: %v", job.Id.Hex(), err)
+}
+
+// run runs Handler, turning its panics into errors.
+func (w *Worker) run(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("mongo: the job handler panicked: %v", r)
+		}
+	}()
+	return w.Handler(ctx, job)
+}
@@ -0,0 +1,174 @@
+package mongo
+
+import (
+	"context"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := ExponentialBackoff(time.Second, time.Minute)
+
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{6, 32 * time.Second},
+		{7, time.Minute},
+		{1000, time.Minute},
+	}
+	for _, test := range tests {
+		if delay := backoff(test.attempts); delay != test.delay {
+			t.Errorf("backoff(%d) = %v, want %v", test.attempts, delay, test.delay)
+		}
+	}
+
+	if delay := ExponentialBackoff(time.Hour, time.Minute)(1); delay != time.Minute {
+		t.Errorf("a base above max gave %v, want %v", delay, time.Minute)
+	}
+}
+
+// testQueue returns an operator of a queue in a scratch database of the
+// server at MONGO_TEST_URL, skipping the test when it isn't set.
+func testQueue(t *testing.T, queue *Queue) *queueOperator {
+	url := os.Getenv("MONGO_TEST_URL")
+	if url == "" {
+		t.Skip("MONGO_TEST_URL isn't set")
+	}
+
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database := "mongo_test_" + bson.NewObjectId().Hex()
+	t.Cleanup(func() {
+		session.DB(database).DropDatabase()
+		session.Close()
+	})
+
+	return queue.SessionOperator(context.Background(), session, database)
+}
+
+func TestQueueClaim(t *testing.T) {
+	q := testQueue(t, NewQueue("jobs"))
+
+	low, err := q.Enqueue(bson.M{"n": 1}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	high, err := q.Enqueue(bson.M{"n": 2}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue(bson.M{"n": 3}, 20, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []*Job{high, low} {
+		job, err := q.Claim()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.Id != want.Id || job.Attempts != 1 || job.Lease == "" {
+			t.Fatalf("claimed %+v, want the job %s on its first attempt", job, want.Id.Hex())
+		}
+	}
+
+	if _, err := q.Claim(); err != ErrQueueEmpty {
+		t.Fatalf("Claim() = %v, want ErrQueueEmpty", err)
+	}
+}
+
+func TestQueueBury(t *testing.T) {
+	queue := NewQueue("jobs")
+	queue.Visibility = 0
+	queue.MaxAttempts = 1
+	q := testQueue(t, queue)
+
+	job, err := q.Enqueue(bson.M{"n": 1}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker of the first attempt died, and the job is buried on the
+	// next claim.
+	if _, err := q.Claim(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Claim(); err != ErrQueueEmpty {
+		t.Fatalf("Claim() = %v, want ErrQueueEmpty", err)
+	}
+
+	dead := &Job{}
+	if err := q.DeadLetters(bson.M{"_id": job.Id}).One(dead); err != nil {
+		t.Fatal(err)
+	}
+	if dead.Attempts != 1 || dead.Failed.IsZero() || dead.LastError == "" {
+		t.Fatalf("buried %+v, want one attempt and the failure", dead)
+	}
+
+	if err := q.Requeue(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	requeued, err := q.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requeued.Id != job.Id || requeued.Attempts != 1 {
+		t.Fatalf("claimed %+v after Requeue, want the job %s on its first attempt", requeued, job.Id.Hex())
+	}
+	if n := q.DeadLetters(nil).Count(); n != 0 {
+		t.Fatalf("%d dead letters left after Requeue", n)
+	}
+}
+
+func TestQueueBuryLeaseLost(t *testing.T) {
+	queue := NewQueue("jobs")
+	queue.Visibility = 0
+	queue.MaxAttempts = 2
+	q := testQueue(t, queue)
+
+	if _, err := q.Enqueue(bson.M{"n": 1}, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	first, err := q.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := q.Claim()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first worker's lease expired, so its dead letter is withdrawn.
+	if err := q.bury(first, "late"); err != ErrLeaseLost {
+		t.Fatalf("bury() = %v, want ErrLeaseLost", err)
+	}
+	if n := q.DeadLetters(nil).Count(); n != 0 {
+		t.Fatalf("%d dead letters left by a lost lease", n)
+	}
+
+	// The second worker buries the job, and the first one failing late
+	// again leaves that dead letter alone.
+	if err := q.bury(second, "failed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.bury(first, "late"); err != ErrLeaseLost {
+		t.Fatalf("bury() = %v, want ErrLeaseLost", err)
+	}
+
+	dead := &Job{}
+	if err := q.DeadLetters(nil).One(dead); err != nil {
+		t.Fatal(err)
+	}
+	if dead.Lease != second.Lease || dead.LastError != "failed" {
+		t.Fatalf("dead letter %+v, want the one of the second worker", dead)
+	}
+}
@@ -1,10 +1,13 @@
 package mongo
 
 import (
+	"context"
 	"reflect"
 	"github.com/go4r/handy"
 	"errors"
 	"strings"
+	"sync"
+	"labix.org/v2/mgo"
 )
 
 type repository struct {
@@ -13,6 +16,30 @@ type repository struct {
 	nilInst    interface{}
 }
 
+var (
+	repositoriesMutex        sync.RWMutex
+	repositoriesByType       = map[reflect.Type]*repository{}
+	repositoriesByCollection = map[string]*repository{}
+)
+
+// register makes the repository known to the populate machinery, both by
+// document type and by collection name.
+func (self *repository) register() {
+	repositoriesMutex.Lock()
+	defer repositoriesMutex.Unlock()
+	repositoriesByType[self.typE] = self
+	repositoriesByCollection[self.collection] = self
+}
+
+func lookupRepository(typ reflect.Type, collection string) *repository {
+	repositoriesMutex.RLock()
+	defer repositoriesMutex.RUnlock()
+	if collection != "" {
+		return repositoriesByCollection[collection]
+	}
+	return repositoriesByType[typ]
+}
+
 func NewRepository(nilInst interface{}) func(interface{}) *repositoryOperator {
 	var collectionName string
 
@@ -30,6 +57,7 @@ func NewRepository(nilInst interface{}) func(interface{}) *repositoryOperator {
 	}
 
 	repo := &repository{collection:collectionName, typE:typ, nilInst:nilInst}
+	repo.register()
 	return func(rc interface{}) *repositoryOperator {
 		return repo.Operator(rc)
 	}
@@ -44,21 +72,31 @@ func NewRepositoryCollection(collectionName string, nilInst interface{}) func(in
 	}
 
 	repo := &repository{collection:collectionName, typE:typ.Elem(), nilInst:nilInst}
+	repo.register()
 	return func(rc interface{}) *repositoryOperator {
 		return repo.Operator(rc)
 	}
 }
 
 func (self *repository) Operator(rc interface{}) (*repositoryOperator) {
-	c := handy.CContext(rc)
+	return self.operator(cContext(rc))
+}
 
+func (self *repository) operator(c *handy.Context) (*repositoryOperator) {
 	repo := c.GetFactory("mongo.repository." + self.collection)
 
 	if repo != nil {
 		return repo().(*repositoryOperator)
 	}
 
-	repository := &repositoryOperator{self, c, CCollection(rc, self.collection)}
+	collection := c.Get("mongo.db").(*mgo.Database).C(self.collection)
+	ctx := c.Get("mongo.context").(context.Context)
+	repository := &repositoryOperator{repository: self, context: c, collection: collection, ctx: ctx}
+
+	// The request deadline bounds the socket operations as well.
+	if _, ok := ctx.Deadline(); ok {
+		repository = repository.WithContext(ctx)
+	}
 	c.SetValue("mongo.repository."+self.collection, repository)
 	return repository
 }
@@ -1,7 +1,11 @@
 package mongo
 
 import (
+	"context"
+	"errors"
+	"reflect"
 	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
 	"github.com/go4r/handy"
 )
 
@@ -9,6 +13,7 @@ type repositoryOperator struct {
 	repository *repository
 	context *handy.Context
 	collection *mgo.Collection
+	ctx context.Context
 }
 
 func (self *repositoryOperator) Context() *handy.Context {
@@ -22,26 +27,52 @@ func (self *repositoryOperator) Collection() *mgo.Collection {
 
 
 func (self *repositoryOperator) Search(selector interface{}) *query {
-	return &query{self, self.collection.Find(selector), 0}
+	return &query{operator: self, query: self.collection.Find(selector), selector: selector}
 }
 
-func (self *repositoryOperator) LoadDocument(doc DocumentWithPrimaryKey) error {
+// rewrite passes document_selector through the rewrite hook of the
+// repository type matching operation, returning the selector to be used.
+func (self *repositoryOperator) rewrite(operation Operation, document_selector interface{}) (interface{}, error) {
+	var err error
+
+	switch operation {
+	case OperationSearch:
+		if doc, is := self.repository.nilInst.(HookRewriteSearch); is {
+			document_selector, err = doc.HookRewriteSearch(self.context, document_selector)
+			err = hookError("HookRewriteSearch", err)
+		}
+	case OperationUpdate:
+		if doc, is := self.repository.nilInst.(HookRewriteUpdate); is {
+			document_selector, err = doc.HookRewriteUpdate(self.context, document_selector)
+			err = hookError("HookRewriteUpdate", err)
+		}
+	case OperationDelete:
+		if doc, is := self.repository.nilInst.(HookRewriteDelete); is {
+			document_selector, err = doc.HookRewriteDelete(self.context, document_selector)
+			err = hookError("HookRewriteDelete", err)
+		}
+	}
+
+	return document_selector, err
+}
+
+// search runs operation between the search hooks of the repository type.
+func (self *repositoryOperator) search(document_selector interface{}, operation func() error) error {
 
-	if doc, is := doc.(HookOnLoad); is {
-		err := doc.HookOnLoad(self.context)
+	if doc, is := self.repository.nilInst.(HookOnSearch); is {
+		err := doc.HookOnSearch(self.context, document_selector)
 		if err != nil {
-			return err
+			return hookError("HookOnSearch", err)
 		}
 	}
 
-	err := self.Collection().Find(doc.PrimaryKey(self.context)).One(doc)
+	err := operation()
 
 	if err == nil {
-
-		if doc, is := doc.(HookAfterLoad); is {
-			err := doc.HookAfterLoad(self.context)
+		if doc, is := self.repository.nilInst.(HookAfterSearch); is {
+			err := doc.HookAfterSearch(self.context, document_selector)
 			if err != nil {
-				return err
+				return hookError("HookAfterSearch", err)
 			}
 		}
 	}
@@ -49,170 +80,352 @@ func (self *repositoryOperator) LoadDocument(doc DocumentWithPrimaryKey) error {
 	return err
 }
 
+// decode unmarshals raw into element running the load hooks around it.
+func (self *repositoryOperator) decode(raw *bson.Raw, element interface{}) error {
+	if err := self.load(element); err != nil {
+		return err
+	}
+	return self.unmarshal(raw, element)
+}
 
-func (self *repositoryOperator) Insert(doc interface{}) error {
-
-	if doc, is := doc.(HookOnInsert); is {
-		err := doc.HookOnInsert(self.context)
+// load runs HookOnLoad on element.
+func (self *repositoryOperator) load(element interface{}) error {
+	if element, ok := element.(HookOnLoad); ok {
+		err := element.HookOnLoad(self.context)
 		if err != nil {
-			return err
+			return hookError("HookOnLoad", err)
 		}
+	}
+	return nil
+}
 
+// unmarshal unmarshals raw into element, running HookAfterLoad after it.
+func (self *repositoryOperator) unmarshal(raw *bson.Raw, element interface{}) error {
+	err := raw.Unmarshal(element)
+	if err != nil {
+		return err
 	}
 
-	err := self.collection.Insert(doc)
+	if element, ok := element.(HookAfterLoad); ok {
+		return hookError("HookAfterLoad", element.HookAfterLoad(self.context))
+	}
 
-	if err == nil {
-		if doc, is := doc.(HookAfterInsert); is {
-			err := doc.HookAfterInsert(self.context)
-			if err != nil {
-				return err
+	return nil
+}
+
+// decodeAll decodes the documents returned by next into slicev, closing the
+// iterator with done. As with mgo's Iter.All, the elements of slicev up to
+// its capacity are decoded into in place before new ones are appended, and
+// the slice returned holds the documents decoded. A failing load hook
+// aborts the whole read unless collect is set, in which case the document
+// is left out and the slice is returned along with the HookErrors of the
+// documents left out.
+func (self *repositoryOperator) decodeAll(next func(*bson.Raw) bool, done func() error, slicev reflect.Value, collect bool) (reflect.Value, error) {
+	slicev = slicev.Slice(0, slicev.Cap())
+	reused := slicev.Len()
+	elemt := slicev.Type().Elem()
+
+	var hookErrors HookErrors
+	var raw bson.Raw
+	i := 0
+	for next(&raw) {
+		if err := self.ctx.Err(); err != nil {
+			done()
+			return reflect.Value{}, err
+		}
+
+		if i == slicev.Len() {
+			slicev = reflect.Append(slicev, reflect.Zero(elemt))
+			slicev = slicev.Slice(0, slicev.Cap())
+		}
+		if err := self.decode(&raw, slicev.Index(i).Addr().Interface()); err != nil {
+			var hookErr *HookError
+			if collect && errors.As(err, &hookErr) {
+				// The next document goes in the same element, which
+				// starts out empty unless it's one being reused.
+				if i >= reused {
+					slicev.Index(i).Set(reflect.Zero(elemt))
+				}
+				hookErrors = append(hookErrors, err)
+				continue
 			}
+			done()
+			return reflect.Value{}, err
 		}
+		i++
 	}
+	slicev = slicev.Slice(0, i)
 
-	return err
+	if err := self.wrapError(done()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	if len(hookErrors) > 0 {
+		return slicev, hookErrors
+	}
+	return slicev, nil
 }
 
-func (self *repositoryOperator) Update(document_selector, doc interface{}) error {
+func (self *repositoryOperator) LoadDocument(doc DocumentWithPrimaryKey) error {
 
-	if doc, is := doc.(HookOnUpdate); is {
-		err := doc.HookOnUpdate(self.context, document_selector)
+	e := &HookEvent{Operation: OperationLoad, Selector: doc.PrimaryKey(self.context), Document: doc}
+
+	return self.run(e, func() error {
+		document_selector, err := self.rewrite(OperationSearch, e.Selector)
 		if err != nil {
 			return err
 		}
+		e.Selector = document_selector
 
-	}
-
-	err := self.collection.Update(document_selector, doc)
+		return self.search(document_selector, func() error {
+			if err := self.load(doc); err != nil {
+				return err
+			}
 
-	if err == nil {
-		if doc, is := doc.(HookAfterUpdate); is {
-			err := doc.HookAfterUpdate(self.context, document_selector)
+			var raw bson.Raw
+			err := self.wrapError(self.Collection().Find(document_selector).One(&raw))
 			if err != nil {
 				return err
 			}
 
+			return self.unmarshal(&raw, doc)
+		})
+	})
+}
+
+
+func (self *repositoryOperator) Insert(doc interface{}) error {
+
+	e := &HookEvent{Operation: OperationInsert, Document: doc}
+
+	return self.run(e, func() error {
+		if doc, is := doc.(HookOnInsert); is {
+			err := doc.HookOnInsert(self.context)
+			if err != nil {
+				return hookError("HookOnInsert", err)
+			}
+
 		}
-	}
 
-	return err
+		err := self.wrapError(self.collection.Insert(doc))
+		e.written = err == nil
+
+		if err == nil {
+			if doc, is := doc.(HookAfterInsert); is {
+				err := self.after(doc, "HookAfterInsert", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterInsert).HookAfterInsert(c)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return err
+	})
 }
 
+func (self *repositoryOperator) Update(document_selector, doc interface{}) error {
+	return self.update(document_selector, doc, nil)
+}
 
-func (self *repositoryOperator) SaveDocument(doc DocumentWithPrimaryKey) error {
+// update updates the document selected by document_selector, provided it
+// matches condition when not nil.
+func (self *repositoryOperator) update(document_selector, doc, condition interface{}) error {
 
-	document_selector := doc.PrimaryKey(self.context)
+	e := &HookEvent{Operation: OperationUpdate, Selector: document_selector, Document: doc}
 
-	if doc, is := doc.(HookOnSave); is {
-		err := doc.HookOnSave(self.context)
+	return self.run(e, func() error {
+		document_selector, err := self.rewrite(OperationUpdate, e.Selector)
 		if err != nil {
 			return err
 		}
+		e.Selector = document_selector
 
-	}
+		if doc, is := doc.(HookOnUpdate); is {
+			err := doc.HookOnUpdate(self.context, document_selector)
+			if err != nil {
+				return hookError("HookOnUpdate", err)
+			}
+
+		}
 
-	changes, err := self.collection.Upsert(doc.PrimaryKey(self.context), doc)
+		self.snapshot(e, document_selector)
 
-	if err == nil {
-		if changes.Updated != 0 {
+		err = self.wrapError(self.collection.Update(conditional(document_selector, condition), doc))
+		e.written = err == nil
+		if err == ErrNotFound && condition != nil {
+			err = ErrPreconditionFailed
+		}
+
+		if err == nil {
 			if doc, is := doc.(HookAfterUpdate); is {
-				err := doc.HookAfterUpdate(self.context, document_selector)
+				err := self.after(doc, "HookAfterUpdate", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterUpdate).HookAfterUpdate(c, document_selector)
+				})
 				if err != nil {
 					return err
 				}
-			}
-		}else {
-			if doc, is := doc.(HookAfterInsert); is {
-				err := doc.HookAfterInsert(self.context)
-				if err != nil {
-					return err
-				}
-			}
-		}
 
-		if doc, is := doc.(HookAfterSave); is {
-			err := doc.HookAfterSave(self.context, changes)
-			if err != nil {
-				return err
 			}
 		}
-	}
 
-	return err
+		return err
+	})
 }
 
-func (self *repositoryOperator) UpdateDocument(doc DocumentWithPrimaryKey) error {
 
-	document_selector := doc.PrimaryKey(self.context)
+func (self *repositoryOperator) SaveDocument(doc DocumentWithPrimaryKey) error {
+	return self.save(doc, nil)
+}
+
+// save upserts doc, or only updates it provided it matches condition when
+// not nil.
+func (self *repositoryOperator) save(doc DocumentWithPrimaryKey, condition interface{}) error {
 
-	if doc, is := doc.(HookOnUpdate); is {
-		err := doc.HookOnUpdate(self.context, document_selector)
+	e := &HookEvent{Operation: OperationSave, Selector: doc.PrimaryKey(self.context), Document: doc}
+
+	return self.run(e, func() error {
+		document_selector, err := self.rewrite(OperationUpdate, e.Selector)
 		if err != nil {
 			return err
 		}
+		e.Selector = document_selector
 
-	}
+		if doc, is := doc.(HookOnSave); is {
+			err := doc.HookOnSave(self.context)
+			if err != nil {
+				return hookError("HookOnSave", err)
+			}
 
-	err := self.collection.Update(document_selector, doc)
+		}
 
-	if err == nil {
-		if doc, is := doc.(HookAfterUpdate); is {
-			err := doc.HookAfterUpdate(self.context, document_selector)
-			if err != nil {
-				return err
+		self.snapshot(e, document_selector)
+
+		var changes *mgo.ChangeInfo
+		if condition == nil {
+			changes, err = self.collection.Upsert(document_selector, doc)
+			err = self.wrapError(err)
+		} else {
+			err = self.wrapError(self.collection.Update(conditional(document_selector, condition), doc))
+			if err == ErrNotFound {
+				err = ErrPreconditionFailed
+			}
+			if err == nil {
+				changes = &mgo.ChangeInfo{Updated: 1}
+			}
+		}
+		e.ChangeInfo = changes
+		e.written = err == nil
+
+		if err == nil {
+			if changes.Updated != 0 {
+				if doc, is := doc.(HookAfterUpdate); is {
+					err := self.after(doc, "HookAfterUpdate", func(doc interface{}, c *handy.Context) error {
+						return doc.(HookAfterUpdate).HookAfterUpdate(c, document_selector)
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}else {
+				if doc, is := doc.(HookAfterInsert); is {
+					err := self.after(doc, "HookAfterInsert", func(doc interface{}, c *handy.Context) error {
+						return doc.(HookAfterInsert).HookAfterInsert(c)
+					})
+					if err != nil {
+						return err
+					}
+				}
 			}
 
+			if doc, is := doc.(HookAfterSave); is {
+				err := self.after(doc, "HookAfterSave", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterSave).HookAfterSave(c, changes)
+				})
+				if err != nil {
+					return err
+				}
+			}
 		}
-	}
 
-	return err
+		return err
+	})
+}
+
+func (self *repositoryOperator) UpdateDocument(doc DocumentWithPrimaryKey) error {
+	return self.update(doc.PrimaryKey(self.context), doc, nil)
 }
 
 func (self *repositoryOperator) Delete(document_query interface{}) error {
 
-	if doc, is := self.repository.nilInst.(HookOnDelete); is {
-		err := doc.HookOnDelete(self.context, document_query)
+	e := &HookEvent{Operation: OperationDelete, Selector: document_query}
+
+	return self.run(e, func() error {
+		document_query, err := self.rewrite(OperationDelete, e.Selector)
 		if err != nil {
 			return err
 		}
-	}
-
-	err := self.collection.Remove(document_query)
+		e.Selector = document_query
 
-	if err == nil {
-		if doc, is := self.repository.nilInst.(HookAfterDelete); is {
-			err := doc.HookAfterDelete(self.context, document_query)
+		if doc, is := self.repository.nilInst.(HookOnDelete); is {
+			err := doc.HookOnDelete(self.context, document_query)
 			if err != nil {
-				return err
+				return hookError("HookOnDelete", err)
 			}
 		}
-	}
 
-	return err
+		err = self.wrapError(self.collection.Remove(document_query))
+		e.written = err == nil
+
+		if err == nil {
+			if doc, is := self.repository.nilInst.(HookAfterDelete); is {
+				err := self.after(doc, "HookAfterDelete", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterDelete).HookAfterDelete(c, document_query)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return err
+	})
 }
 
 
 func (self *repositoryOperator) DeleteDocument(doc DocumentWithPrimaryKey) error {
-	document_selector := doc.PrimaryKey(self.context)
 
-	if doc, is := doc.(HookOnDelete); is {
-		err := doc.HookOnDelete(self.context, document_selector)
+	e := &HookEvent{Operation: OperationDelete, Selector: doc.PrimaryKey(self.context), Document: doc}
+
+	return self.run(e, func() error {
+		document_selector, err := self.rewrite(OperationDelete, e.Selector)
 		if err != nil {
 			return err
 		}
-	}
+		e.Selector = document_selector
 
-	err := self.collection.Remove(document_selector)
-
-	if err == nil {
-		if doc, is := doc.(HookAfterDelete); is {
-			err := doc.HookAfterDelete(self.context, document_selector)
+		if doc, is := doc.(HookOnDelete); is {
+			err := doc.HookOnDelete(self.context, document_selector)
 			if err != nil {
-				return err
+				return hookError("HookOnDelete", err)
 			}
 		}
-	}
 
-	return err
+		err = self.wrapError(self.collection.Remove(document_selector))
+		e.written = err == nil
+
+		if err == nil {
+			if doc, is := doc.(HookAfterDelete); is {
+				err := self.after(doc, "HookAfterDelete", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterDelete).HookAfterDelete(c, document_selector)
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return err
+	})
 }
@@ -0,0 +1,529 @@
+package mongo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go4r/handy"
+	"io/ioutil"
+	"labix.org/v2/mgo/bson"
+	"mime"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Router is the routing interface of the handy server, which the resources
+// and file handlers are mounted on. The handlers find the handy context of
+// the request through handy.CContext, so another router, such as an
+// *http.ServeMux, must itself be served through handy.
+type Router interface {
+	HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request))
+}
+
+// DocumentWithResourceKey is implemented by the document types whose key
+// isn't an _id field holding the id of their item routes. SetResourceKey
+// sets the key from the id, the document being then selected through
+// PrimaryKey.
+type DocumentWithResourceKey interface {
+	SetResourceKey(id string) error
+}
+
+// ErrorWithStatus is implemented by the errors, typically returned by
+// hooks, choosing the status code of the response of a Resource.
+type ErrorWithStatus interface {
+	StatusCode() int
+}
+
+// requestError is a malformed request, answered with 400 Bad Request.
+type requestError struct {
+	err error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+func (e *requestError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+// Resource serves a repository as a REST resource:
+//
+//     GET    /prefix          lists the documents, see below
+//     POST   /prefix          inserts the document in the body
+//     GET    /prefix/{id}     returns the document
+//     PUT    /prefix/{id}     updates the document with the body
+//     PATCH  /prefix/{id}     applies the JSON Patch or Merge Patch body
+//     DELETE /prefix/{id}     deletes the document
+//
+// Documents are encoded in JSON. The list route returns an OffsetPage
+// selected by the page and size parameters, or a CursorPage when the
+// cursor parameter is given, empty for the first page. The other
+// parameters filter, sort and select the fields of the documents, see
+// QueryParser:
+//
+//     GET /users?status=active&age__gte=18&sort=-created&page=2&size=50
+//
+// PATCH takes an application/json-patch+json body, see PatchDocument, or
+// an application/merge-patch+json one, see MergePatchDocument, and
+// returns the patched document.
+//
+// GET, PUT and PATCH return the ETag of the document, see ETag. GET
+// answers 304 Not Modified when it's listed in If-None-Match, and PUT and
+// PATCH fail with 412 Precondition Failed when If-Match is given and the
+// stored document doesn't match it.
+//
+// The operations go through the repository, so hooks and middlewares
+// apply. Errors map to status codes: ErrNotFound to 404, ErrDuplicateKey
+// and ErrPatchTestFailed to 409, ErrValidation to 422, the other hook
+// errors to 403 and context errors to 503, unless they implement
+// ErrorWithStatus. The responses carry the status text as message, or the
+// message of the malformed request errors of the package, never the one of
+// the error itself.
+type Resource struct {
+	Repository func(interface{}) *repositoryOperator
+
+	// Fields restricts the fields the list route may be filtered, sorted
+	// and selected on. It defaults to every field of the document type.
+	Fields []string
+	// PageSize is the default size of the pages of the list route, and
+	// MaxPageSize its upper bound.
+	PageSize    int
+	MaxPageSize int
+	// MaxBodySize bounds the size of the request bodies.
+	MaxBodySize int64
+}
+
+func NewResource(repo func(interface{}) *repositoryOperator) *Resource {
+	return &Resource{
+		Repository:  repo,
+		PageSize:    20,
+		MaxPageSize: 100,
+		MaxBodySize: 1 << 20,
+	}
+}
+
+// MountResource mounts a Resource serving repo under prefix on the handy
+// server:
+//
+//     mongo.MountResource("/users", Users)
+//
+func MountResource(prefix string, repo func(interface{}) *repositoryOperator) *Resource {
+	res := NewResource(repo)
+	res.Mount(prefix)
+	return res
+}
+
+// Mount registers the collection and item routes of the resource under
+// prefix on the handy server.
+func (res *Resource) Mount(prefix string) {
+	res.MountOn(handy.Server, prefix)
+}
+
+// MountOn registers the routes of the resource on router, see Router.
+func (res *Resource) MountOn(router Router, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	router.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		res.serveCollection(w, r, prefix)
+	})
+	router.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, prefix+"/")
+		switch {
+		case id == "":
+			res.serveCollection(w, r, prefix)
+		case strings.Contains(id, "/"):
+			http.NotFound(w, r)
+		default:
+			res.serveItem(w, r, id)
+		}
+	})
+}
+
+func (res *Resource) serveCollection(w http.ResponseWriter, r *http.Request, prefix string) {
+	switch r.Method {
+	case "GET", "HEAD":
+		res.list(w, r)
+	case "POST":
+		res.create(w, r, prefix)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (res *Resource) serveItem(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case "GET", "HEAD":
+		res.get(w, r, id)
+	case "PUT":
+		res.put(w, r, id)
+	case "PATCH":
+		res.patch(w, r, id)
+	case "DELETE":
+		res.delete(w, r, id)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, PATCH, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (res *Resource) list(w http.ResponseWriter, r *http.Request) {
+	operator := res.Repository(r)
+	params := r.URL.Query()
+
+	size := res.PageSize
+	if param := params.Get("size"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			res.error(w, &requestError{ErrInvalidPage})
+			return
+		}
+		size = n
+	}
+	if res.MaxPageSize > 0 && size > res.MaxPageSize {
+		size = res.MaxPageSize
+	}
+
+	// The page is selected by page and size, or cursor and size, in place
+	// of skip and limit.
+	filters := url.Values{}
+	for name, values := range params {
+		switch name {
+		case "page", "size", "cursor", "skip", "limit":
+		default:
+			filters[name] = values
+		}
+	}
+
+	parsed, err := NewQueryParser(operator.repository.nilInst, res.Fields...).Parse(filters)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+	q := parsed.Search(operator)
+
+	if _, paginate := params["cursor"]; paginate {
+		page, err := q.Paginate("", params.Get("cursor"), size)
+		if err != nil {
+			res.error(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+		return
+	}
+
+	number := 1
+	if param := params.Get("page"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil {
+			res.error(w, &requestError{ErrInvalidPage})
+			return
+		}
+		number = n
+	}
+
+	page, err := q.Page(number, size)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (res *Resource) create(w http.ResponseWriter, r *http.Request, prefix string) {
+	operator := res.Repository(r)
+
+	doc, err := res.decode(w, r, operator)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	if err := operator.Insert(doc); err != nil {
+		res.error(w, err)
+		return
+	}
+
+	if id := documentId(doc); id != nil {
+		w.Header().Set("Location", prefix+"/"+resourceId(id))
+	}
+	writeJSON(w, http.StatusCreated, doc)
+}
+
+func (res *Resource) get(w http.ResponseWriter, r *http.Request, id string) {
+	operator := res.Repository(r)
+	doc := reflect.New(operator.repository.typE).Interface()
+
+	selector, err := res.key(operator, doc, id)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	if pk, is := doc.(DocumentWithPrimaryKey); is {
+		err = operator.LoadDocument(pk)
+	} else {
+		err = operator.Search(selector).One(doc)
+	}
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	etag, err := ETag(doc)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && ETagMatches(ifNoneMatch, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (res *Resource) put(w http.ResponseWriter, r *http.Request, id string) {
+	operator := res.Repository(r)
+
+	doc, err := res.decode(w, r, operator)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	selector, err := res.key(operator, doc, id)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	var condition interface{}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if condition, err = operator.matchCondition(selector, ifMatch); err != nil {
+			res.error(w, err)
+			return
+		}
+	}
+
+	if err := operator.update(selector, doc, condition); err != nil {
+		res.error(w, err)
+		return
+	}
+
+	etag, err := ETag(doc)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (res *Resource) patch(w http.ResponseWriter, r *http.Request, id string) {
+	operator := res.Repository(r)
+	typ := operator.repository.typE
+
+	body := r.Body
+	if res.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, res.MaxBodySize)
+	}
+	patch, err := ioutil.ReadAll(body)
+	if err != nil {
+		res.error(w, &requestError{err})
+		return
+	}
+
+	var update *patchUpdate
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json-patch+json":
+		update, err = jsonPatchUpdate(typ, patch)
+	case "application/merge-patch+json", "application/json":
+		update, err = mergePatchUpdate(typ, patch)
+	default:
+		w.Header().Set("Accept-Patch", "application/json-patch+json, application/merge-patch+json")
+		writeJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": http.StatusText(http.StatusUnsupportedMediaType)})
+		return
+	}
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	doc := reflect.New(typ).Interface()
+	selector, err := res.key(operator, doc, id)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	var condition interface{}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if condition, err = operator.matchCondition(selector, ifMatch); err != nil {
+			res.error(w, err)
+			return
+		}
+	}
+
+	if err := operator.patch(selector, doc, update, condition); err != nil {
+		res.error(w, err)
+		return
+	}
+
+	etag, err := ETag(doc)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	writeJSON(w, http.StatusOK, doc)
+}
+
+func (res *Resource) delete(w http.ResponseWriter, r *http.Request, id string) {
+	operator := res.Repository(r)
+	doc := reflect.New(operator.repository.typE).Interface()
+
+	selector, err := res.key(operator, doc, id)
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	if pk, is := doc.(DocumentWithPrimaryKey); is {
+		err = operator.DeleteDocument(pk)
+	} else {
+		err = operator.Delete(selector)
+	}
+	if err != nil {
+		res.error(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decode returns a new document of the repository type decoded from the
+// body of r.
+func (res *Resource) decode(w http.ResponseWriter, r *http.Request, operator *repositoryOperator) (interface{}, error) {
+	body := r.Body
+	if res.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, body, res.MaxBodySize)
+	}
+
+	doc := reflect.New(operator.repository.typE).Interface()
+	if err := json.NewDecoder(body).Decode(doc); err != nil {
+		return nil, &requestError{err}
+	}
+	return doc, nil
+}
+
+// key sets the key of the item route id on doc, and returns the selector
+// of the document.
+func (res *Resource) key(operator *repositoryOperator, doc interface{}, id string) (interface{}, error) {
+	var key interface{} = id
+
+	if doc, is := doc.(DocumentWithResourceKey); is {
+		if err := doc.SetResourceKey(id); err != nil {
+			return nil, &requestError{err}
+		}
+	} else {
+		value := reflect.ValueOf(doc).Elem()
+		if bson.IsObjectIdHex(id) {
+			key = bson.ObjectIdHex(id)
+		}
+
+		if value.Kind() == reflect.Struct {
+			if field, ok := fieldByBSONName(value, "_id"); ok {
+				parsed, err := parseValue(field.Type(), id)
+				if err != nil {
+					return nil, ErrNotFound
+				}
+				field.Set(parsed)
+				key = parsed.Interface()
+			}
+		}
+	}
+
+	if doc, is := doc.(DocumentWithPrimaryKey); is {
+		return doc.PrimaryKey(operator.context), nil
+	}
+	return bson.M{"_id": key}, nil
+}
+
+// resourceId returns the id of the item route of the document with the
+// given _id.
+func resourceId(id interface{}) string {
+	if id, is := id.(bson.ObjectId); is {
+		return id.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// statusCode returns the status code of the response failing with err.
+func statusCode(err error) int {
+	var withStatus ErrorWithStatus
+	switch {
+	case errors.As(err, &withStatus):
+		return withStatus.StatusCode()
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrDuplicateKey), errors.Is(err, ErrPatchTestFailed):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidPage), errors.Is(err, ErrInvalidQuery),
+		errors.Is(err, ErrInvalidPatch):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrValidation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrHookAborted):
+		return http.StatusForbidden
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func (res *Resource) error(w http.ResponseWriter, err error) {
+	writeError(w, err)
+}
+
+// publicErrors are the errors whose message is sent to the clients, as it
+// only describes their request.
+var publicErrors = []error{
+	ErrInvalidCursor, ErrInvalidPage, ErrInvalidQuery, ErrInvalidPatch,
+	ErrPatchTestFailed, ErrPreconditionFailed, ErrNoFile,
+}
+
+// writeError writes the response of a request failing with err. Its message
+// isn't disclosed, as it may come from a hook or the server.
+func writeError(w http.ResponseWriter, err error) {
+	status := statusCode(err)
+
+	message := http.StatusText(status)
+	for _, public := range publicErrors {
+		if errors.Is(err, public) {
+			message = public.Error()
+			break
+		}
+	}
+
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,211 @@
+package mongo
+
+import (
+	"errors"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// minTailTimeout is the shortest delay at which a TailIter checks its
+// context.
+const minTailTimeout = 100 * time.Millisecond
+
+// TailIter iterates over the documents of a capped collection as they are
+// inserted, see query.Tail.
+type TailIter struct {
+	// Retry is the pause before the query is restarted once the cursor
+	// died or the connection failed.
+	Retry time.Duration
+
+	query   *query
+	timeout time.Duration
+	key     string
+	last    interface{}
+	iter    *mgo.Iter
+	err     error
+
+	hookErrors HookErrors
+}
+
+// Tail returns an iterator over the documents of the query on a capped
+// collection, following the documents inserted afterwards.
+//
+// Unlike the mgo tailable iterator, Next keeps waiting through the idle
+// timeouts, timeout being only the delay at which the context is checked
+// (raised to 100ms, as mgo would otherwise never return or poll in a loop),
+// and restarts the query after the last _id seen when the cursor dies or
+// the connection fails, so the _id must grow with the insertion order, as
+// ObjectIds do. It returns false once the context of the operator is done
+// (that is when the request is), or on any other error:
+//
+//     iter := Events(r).Search(bson.M{"kind": "alert"}).Tail(5 * time.Second)
+//     var event Event
+//     for iter.Next(&event) {
+//             send(event)
+//     }
+//     if err := iter.Close(); err != nil && err != context.Canceled {
+//             return err
+//     }
+//
+// The search hooks run once when the query starts, and the load hooks run
+// on every document. With CollectHookErrors the documents whose load hooks
+// fail are skipped, and Close returns their HookErrors.
+func (self *query) Tail(timeout time.Duration) *TailIter {
+	return self.tail(timeout, "_id", nil)
+}
+
+// tail returns the iterator resuming after the last value of key seen,
+// starting after the value after unless nil.
+func (self *query) tail(timeout time.Duration, key string, after interface{}) *TailIter {
+	if timeout < minTailTimeout {
+		timeout = minTailTimeout
+	}
+
+	it := &TailIter{Retry: time.Second, query: self, timeout: timeout, key: key, last: after}
+
+	it.err = self.run(nil, func() error {
+		it.start()
+		return nil
+	})
+
+	return it
+}
+
+// start runs the query from the position of the iterator.
+func (it *TailIter) start() {
+	selector := it.query.resolved
+	if it.last != nil {
+		after := bson.M{"$gt": it.last}
+
+		// The bound is kept at the top level when possible, where the
+		// LogReplay option looks for it.
+		if fields, is := selector.(bson.M); is && fields[it.key] == nil {
+			bounded := bson.M{it.key: after}
+			for field, value := range fields {
+				bounded[field] = value
+			}
+			selector = bounded
+		} else if selector == nil {
+			selector = bson.M{it.key: after}
+		} else {
+			selector = bson.M{"$and": []interface{}{selector, bson.M{it.key: after}}}
+		}
+	}
+
+	it.iter = it.query.derive(selector).Sort("$natural").Tail(it.timeout)
+}
+
+// Next decodes the next document into result, waiting for it to be
+// inserted. It returns false once the iteration is over, see Err.
+func (it *TailIter) Next(result interface{}) bool {
+	operator := it.query.operator
+
+	for it.err == nil {
+		if err := operator.ctx.Err(); err != nil {
+			it.err = err
+			break
+		}
+
+		if it.iter == nil {
+			it.start()
+		}
+
+		var raw bson.Raw
+		if it.iter.Next(&raw) {
+			if last, err := rawField(&raw, it.key); err == nil {
+				it.last = last
+			}
+
+			err := operator.decode(&raw, result)
+			if err == nil {
+				err = operator.populate(result, it.query.populate)
+			}
+			if err == nil {
+				return true
+			}
+
+			var hookErr *HookError
+			if errors.As(err, &hookErr) && it.query.collectErrors {
+				it.hookErrors = append(it.hookErrors, err)
+				continue
+			}
+			it.err = err
+			break
+		}
+
+		if it.iter.Timeout() {
+			continue
+		}
+
+		// The cursor died, or never lived when the query matched nothing
+		// yet: the query is restarted after a pause, unless it failed
+		// for good.
+		err := it.iter.Close()
+		it.iter = nil
+
+		if err != nil {
+			if !isTransient(err) {
+				it.err = operator.wrapError(err)
+				break
+			}
+			operator.collection.Database.Session.Refresh()
+		}
+
+		select {
+		case <-operator.ctx.Done():
+		case <-time.After(it.Retry):
+		}
+	}
+
+	if it.iter != nil {
+		it.iter.Close()
+		it.iter = nil
+	}
+	return false
+}
+
+// Last returns the last _id seen, from which the query of a new iterator
+// may be resumed.
+func (it *TailIter) Last() interface{} {
+	return it.last
+}
+
+// Err returns the error which ended the iteration, the context error when
+// the context is done.
+func (it *TailIter) Err() error {
+	return it.err
+}
+
+// Close stops the iteration, returning the error which ended it or the
+// HookErrors of the documents skipped.
+func (it *TailIter) Close() error {
+	if it.iter != nil {
+		if err := it.iter.Close(); err != nil && it.err == nil {
+			it.err = it.query.operator.wrapError(err)
+		}
+		it.iter = nil
+	}
+
+	if it.err == nil && len(it.hookErrors) > 0 {
+		return it.hookErrors
+	}
+	return it.err
+}
+
+// rawField returns the value of the top level field name of raw.
+func rawField(raw *bson.Raw, name string) (interface{}, error) {
+	var fields bson.RawD
+	if err := raw.Unmarshal(&fields); err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		if field.Name == name {
+			var value interface{}
+			err := field.Value.Unmarshal(&value)
+			return value, err
+		}
+	}
+	return nil, ErrNotFound
+}
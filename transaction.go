@@ -0,0 +1,709 @@
+package mongo
+
+import (
+	"context"
+	"errors"
+	"github.com/go4r/handy"
+	"io"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"labix.org/v2/mgo/txn"
+	"net"
+	"reflect"
+	"strings"
+)
+
+// TransactionCollection is the collection holding the transactions run by
+// WithTransaction. mgo/txn keeps the documents inserted and removed by the
+// transactions in the collection of the same name suffixed by ".stash".
+var TransactionCollection = "mongo.txns"
+
+// TransactionRetries is the number of times a commit interrupted by a
+// network error is resumed before giving up.
+var TransactionRetries = 3
+
+var (
+	// ErrTransactionAborted is returned when a transaction was aborted
+	// without any change because one of its operations couldn't apply:
+	// an inserted document already exists, or an updated or deleted one
+	// is missing or fails its assertion.
+	ErrTransactionAborted = errors.New("mongo: transaction aborted")
+
+	ErrTransactionSelector = errors.New("mongo: transaction operations must select a single document by _id")
+	ErrTransactionNoId     = errors.New("mongo: transaction document has no _id")
+	ErrTransactionDone     = errors.New("mongo: transaction is already done")
+)
+
+// TransactionError is returned when a commit failed without the
+// transaction being aborted. The transaction may be partially applied: it
+// is completed by ResumeTransaction with Id, by ResumeTransactions, or by
+// the next transaction writing one of its documents.
+type TransactionError struct {
+	Id  bson.ObjectId
+	Err error
+}
+
+func (e *TransactionError) Error() string {
+	return "mongo: transaction " + e.Id.Hex() + " interrupted: " + e.Err.Error()
+}
+
+func (e *TransactionError) Unwrap() error {
+	return e.Err
+}
+
+// Tx collects the writes of a transaction, see WithTransaction.
+type Tx struct {
+	id       bson.ObjectId
+	rc       interface{}
+	context  *handy.Context
+	ctx      context.Context
+	database *mgo.Database
+	ops      []txn.Op
+	writes   []*txWrite
+	done     bool
+}
+
+// txWrite is a write queued in a transaction, along with the middlewares
+// and the after hook to run once the transaction is committed.
+type txWrite struct {
+	event       *HookEvent
+	middlewares []Middleware
+	ran         int
+	after       func() error
+}
+
+// TxOperator queues the writes of a repository in a transaction.
+type TxOperator struct {
+	tx       *Tx
+	operator *repositoryOperator
+}
+
+// WithTransaction runs fn and applies the writes it queued on tx
+// atomically: either all of them are applied or none is.
+//
+// mgo doesn't speak the server-side transactions of MongoDB 4, so the
+// writes are applied with the two-phase commit of mgo/txn, which works on
+// every server version. Its guarantees only hold as long as the documents
+// written in transactions are never written outside of them. The writes
+// are queued on tx and sent once fn returned nil, so reads made within fn
+// don't see them, and returning an error discards them all.
+//
+// The writes run the rewrite hooks, the On hooks of the document and the
+// Before functions of the middlewares when they are queued, and the After
+// functions and the after hooks of the document once the transaction is
+// committed. When fn fails, the After functions still run, with its
+// error. Fields other than _id left in the selectors, such as the ones
+// added by a rewrite hook, become assertions of the transaction.
+//
+// A commit interrupted by a network error is resumed up to
+// TransactionRetries times, and a TransactionError is returned when it
+// still fails. ErrTransactionAborted is returned when the writes couldn't
+// apply:
+//
+//     err := mongo.WithTransaction(r, func(tx *mongo.Tx) error {
+//             accounts := tx.Repository(Accounts)
+//             if err := accounts.Update(bson.M{"_id": from}, bson.M{"$inc": bson.M{"balance": -amount}}); err != nil {
+//                     return err
+//             }
+//             return accounts.Update(bson.M{"_id": to}, bson.M{"$inc": bson.M{"balance": amount}})
+//     })
+//
+func WithTransaction(rc interface{}, fn func(tx *Tx) error) error {
+	c := cContext(rc)
+
+	tx := &Tx{
+		id:       bson.NewObjectId(),
+		rc:       rc,
+		context:  c,
+		ctx:      c.Get("mongo.context").(context.Context),
+		database: c.Get("mongo.db").(*mgo.Database),
+	}
+
+	if err := fn(tx); err != nil {
+		tx.abort(err)
+		return err
+	}
+
+	return tx.commit()
+}
+
+// Id returns the id of the transaction, which may be recorded ahead of the
+// commit to resume it should the process die.
+func (tx *Tx) Id() bson.ObjectId {
+	return tx.id
+}
+
+// Repository returns the operator queuing the writes of repo in the
+// transaction.
+func (tx *Tx) Repository(repo func(interface{}) *repositoryOperator) *TxOperator {
+	return &TxOperator{tx: tx, operator: repo(tx.rc)}
+}
+
+// queue adds op to the transaction, along with the outbox entry recording
+// it when the repository has an outbox.
+func (tx *Tx) queue(op txn.Op, w *txWrite) error {
+	e := w.event
+	ops := []txn.Op{op}
+
+	if isWrite(e.Operation) && outboxEnabled(e.Collection) {
+		entry, err := outboxEntry(e)
+		if err != nil {
+			return err
+		}
+		entry.State = outboxReady
+		ops = append(ops, txn.Op{C: OutboxCollection, Id: entry.Id, Assert: txn.DocMissing, Insert: entry})
+	}
+
+	tx.ops = append(tx.ops, ops...)
+	tx.writes = append(tx.writes, w)
+	return nil
+}
+
+// commit runs the queued operations, and then the middlewares and the after
+// hooks of the writes.
+func (tx *Tx) commit() error {
+	tx.done = true
+
+	if len(tx.ops) == 0 {
+		return nil
+	}
+
+	err := tx.apply()
+
+	for _, w := range tx.writes {
+		e := w.event
+		written := err == nil && isWrite(e.Operation)
+
+		var afterErr error
+		if written && w.after != nil {
+			afterErr = w.after()
+		}
+
+		afterErr = runAfter(w.middlewares, w.ran, e, firstError(err, afterErr))
+		if err == nil && afterErr != nil {
+			err = afterErr
+		}
+
+		if written {
+			if change := changeEvent(e); change != nil {
+				Events.Publish(change)
+			}
+		}
+	}
+
+	return err
+}
+
+// abort drops the queued operations when fn failed with err, running the
+// After functions of the middlewares whose Before ran, as a failed commit
+// does.
+func (tx *Tx) abort(err error) {
+	tx.done = true
+
+	for _, w := range tx.writes {
+		runAfter(w.middlewares, w.ran, w.event, err)
+	}
+}
+
+// apply runs the queued operations, resuming the transaction when the
+// connection fails.
+func (tx *Tx) apply() error {
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+
+	// The commit runs on a session of its own, refreshed on failures
+	// without resetting the session shared by the request.
+	session := tx.database.Session.Copy()
+	defer session.Close()
+	database := tx.database.With(session)
+
+	runner := txn.NewRunner(database.C(TransactionCollection))
+
+	err := runner.Run(tx.ops, tx.id, nil)
+	for retry := 0; isTransient(err) && retry < TransactionRetries; retry++ {
+		if tx.ctx.Err() != nil {
+			break
+		}
+
+		session.Refresh()
+
+		// The transaction is resumed when its document made it to the
+		// server, and run again otherwise.
+		var saved bool
+		if saved, err = transactionSaved(database, tx.id); err == nil {
+			if saved {
+				err = runner.Resume(tx.id)
+			} else {
+				err = runner.Run(tx.ops, tx.id, nil)
+			}
+		}
+	}
+
+	switch {
+	case err == nil:
+		return nil
+	case err == txn.ErrAborted:
+		return ErrTransactionAborted
+	case tx.ctx.Err() != nil:
+		return &TransactionError{Id: tx.id, Err: tx.ctx.Err()}
+	}
+	return &TransactionError{Id: tx.id, Err: err}
+}
+
+// ResumeTransactions completes the transactions of database left
+// unfinished, typically by a process that died while committing them. It's
+// meant to run at startup; the hooks, middlewares and change events of the
+// resumed writes don't run.
+func ResumeTransactions(database *mgo.Database) error {
+	return txn.NewRunner(database.C(TransactionCollection)).ResumeAll()
+}
+
+// ResumeTransaction completes the transaction id, see TransactionError. It
+// returns nil when the transaction is applied, ErrTransactionAborted when
+// it was aborted and ErrNotFound when it never made it to the server.
+func ResumeTransaction(database *mgo.Database, id bson.ObjectId) error {
+	// mgo/txn tells a missing transaction by its error message only.
+	saved, err := transactionSaved(database, id)
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return ErrNotFound
+	}
+
+	err = txn.NewRunner(database.C(TransactionCollection)).Resume(id)
+	if err == txn.ErrAborted {
+		return ErrTransactionAborted
+	}
+	return err
+}
+
+// transactionSaved reports whether the document of the transaction id is
+// in database.
+func transactionSaved(database *mgo.Database, id bson.ObjectId) (bool, error) {
+	n, err := database.C(TransactionCollection).FindId(id).Count()
+	return n > 0, err
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isTransient reports whether err is a connection failure after which the
+// operation may be retried.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	_, is := err.(net.Error)
+	return is
+}
+
+// Insert queues the insertion of doc, which must have an _id once
+// HookOnInsert ran. The transaction aborts when the document already exists.
+func (self *TxOperator) Insert(doc interface{}) error {
+	e := &HookEvent{Operation: OperationInsert, Document: doc}
+
+	return self.queue(e, func() (*txn.Op, func() error, error) {
+		if doc, is := doc.(HookOnInsert); is {
+			if err := doc.HookOnInsert(self.operator.context); err != nil {
+				return nil, nil, hookError("HookOnInsert", err)
+			}
+		}
+
+		id := documentId(doc)
+		if id == nil {
+			return nil, nil, ErrTransactionNoId
+		}
+		e.Selector = bson.M{"_id": id}
+
+		var after func() error
+		if doc, is := doc.(HookAfterInsert); is {
+			after = func() error {
+				return self.operator.after(doc, "HookAfterInsert", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterInsert).HookAfterInsert(c)
+				})
+			}
+		}
+
+		return &txn.Op{Id: id, Assert: txn.DocMissing, Insert: doc}, after, nil
+	})
+}
+
+// Update queues the update of the document selected by document_selector,
+// which must select it by _id, other fields being asserted. doc is either
+// an update document ($set, $inc...) or a replacement document, applied as
+// a $set of its fields. The transaction aborts when the document is
+// missing or doesn't match the assertions.
+func (self *TxOperator) Update(document_selector, doc interface{}) error {
+	e := &HookEvent{Operation: OperationUpdate, Selector: document_selector, Document: doc}
+	return self.update(e, doc)
+}
+
+// UpdateDocument queues the update of doc, see Update.
+func (self *TxOperator) UpdateDocument(doc DocumentWithPrimaryKey) error {
+	e := &HookEvent{Operation: OperationUpdate, Selector: doc.PrimaryKey(self.operator.context), Document: doc}
+	return self.update(e, doc)
+}
+
+func (self *TxOperator) update(e *HookEvent, doc interface{}) error {
+	return self.queue(e, func() (*txn.Op, func() error, error) {
+		document_selector, err := self.operator.rewrite(OperationUpdate, e.Selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.Selector = document_selector
+
+		if doc, is := doc.(HookOnUpdate); is {
+			if err := doc.HookOnUpdate(self.operator.context, document_selector); err != nil {
+				return nil, nil, hookError("HookOnUpdate", err)
+			}
+		}
+
+		id, assert, err := splitSelector(document_selector)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		update, err := updateDocument(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var after func() error
+		if doc, is := doc.(HookAfterUpdate); is {
+			after = func() error {
+				return self.operator.after(doc, "HookAfterUpdate", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterUpdate).HookAfterUpdate(c, document_selector)
+				})
+			}
+		}
+
+		return &txn.Op{Id: id, Assert: assert, Update: update}, after, nil
+	})
+}
+
+// SaveDocument queues the insertion of doc, or its update when it exists
+// by the time it's queued. The transaction aborts when the document was
+// inserted or deleted in between.
+func (self *TxOperator) SaveDocument(doc DocumentWithPrimaryKey) error {
+	e := &HookEvent{Operation: OperationSave, Selector: doc.PrimaryKey(self.operator.context), Document: doc}
+
+	return self.queue(e, func() (*txn.Op, func() error, error) {
+		document_selector, err := self.operator.rewrite(OperationUpdate, e.Selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.Selector = document_selector
+
+		if doc, is := doc.(HookOnSave); is {
+			if err := doc.HookOnSave(self.operator.context); err != nil {
+				return nil, nil, hookError("HookOnSave", err)
+			}
+		}
+
+		id, assert, err := splitSelector(document_selector)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		n, err := self.operator.collection.FindId(id).Count()
+		if err != nil {
+			return nil, nil, self.operator.wrapError(err)
+		}
+
+		op := &txn.Op{Id: id, Assert: txn.DocMissing, Insert: doc}
+		e.ChangeInfo = &mgo.ChangeInfo{UpsertedId: id}
+
+		if n > 0 {
+			update, err := updateDocument(doc)
+			if err != nil {
+				return nil, nil, err
+			}
+			op = &txn.Op{Id: id, Assert: assert, Update: update}
+			e.ChangeInfo = &mgo.ChangeInfo{Updated: 1}
+		}
+
+		changes := e.ChangeInfo
+		after := func() error {
+			if changes.Updated != 0 {
+				if doc, is := doc.(HookAfterUpdate); is {
+					err := self.operator.after(doc, "HookAfterUpdate", func(doc interface{}, c *handy.Context) error {
+						return doc.(HookAfterUpdate).HookAfterUpdate(c, document_selector)
+					})
+					if err != nil {
+						return err
+					}
+				}
+			} else {
+				if doc, is := doc.(HookAfterInsert); is {
+					err := self.operator.after(doc, "HookAfterInsert", func(doc interface{}, c *handy.Context) error {
+						return doc.(HookAfterInsert).HookAfterInsert(c)
+					})
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			if doc, is := doc.(HookAfterSave); is {
+				return self.operator.after(doc, "HookAfterSave", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterSave).HookAfterSave(c, changes)
+				})
+			}
+			return nil
+		}
+
+		return op, after, nil
+	})
+}
+
+// Delete queues the removal of the document selected by document_query,
+// which must select it by _id, other fields being asserted. The
+// transaction aborts when the document is missing or doesn't match the
+// assertions.
+func (self *TxOperator) Delete(document_query interface{}) error {
+	e := &HookEvent{Operation: OperationDelete, Selector: document_query}
+	return self.delete(e, self.operator.repository.nilInst)
+}
+
+// DeleteDocument queues the removal of doc, see Delete.
+func (self *TxOperator) DeleteDocument(doc DocumentWithPrimaryKey) error {
+	e := &HookEvent{Operation: OperationDelete, Selector: doc.PrimaryKey(self.operator.context), Document: doc}
+	return self.delete(e, doc)
+}
+
+// delete queues the removal described by e, running the hooks of
+// hooked, the deleted document or the nil instance of the repository.
+func (self *TxOperator) delete(e *HookEvent, hooked interface{}) error {
+	return self.queue(e, func() (*txn.Op, func() error, error) {
+		document_selector, err := self.operator.rewrite(OperationDelete, e.Selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.Selector = document_selector
+
+		if doc, is := hooked.(HookOnDelete); is {
+			if err := doc.HookOnDelete(self.operator.context, document_selector); err != nil {
+				return nil, nil, hookError("HookOnDelete", err)
+			}
+		}
+
+		id, assert, err := splitSelector(document_selector)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var after func() error
+		if doc, is := hooked.(HookAfterDelete); is {
+			after = func() error {
+				return self.operator.after(doc, "HookAfterDelete", func(doc interface{}, c *handy.Context) error {
+					return doc.(HookAfterDelete).HookAfterDelete(c, document_selector)
+				})
+			}
+		}
+
+		return &txn.Op{Id: id, Assert: assert, Remove: true}, after, nil
+	})
+}
+
+// Assert makes the transaction abort unless the document selected by
+// document_selector exists and matches its other fields when the
+// transaction is applied, the selector going through HookRewriteSearch.
+func (self *TxOperator) Assert(document_selector interface{}) error {
+	e := &HookEvent{Operation: OperationSearch, Selector: document_selector}
+
+	return self.queue(e, func() (*txn.Op, func() error, error) {
+		document_selector, err := self.operator.rewrite(OperationSearch, e.Selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.Selector = document_selector
+
+		id, assert, err := splitSelector(document_selector)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return &txn.Op{Id: id, Assert: assert}, nil, nil
+	})
+}
+
+// queue runs the Before functions of the middlewares and then prepare,
+// which runs the hooks of the write and returns its transaction operation
+// along with its after hook, and adds the operation to the transaction.
+func (self *TxOperator) queue(e *HookEvent, prepare func() (*txn.Op, func() error, error)) error {
+	tx := self.tx
+	if tx.done {
+		return ErrTransactionDone
+	}
+	if err := tx.ctx.Err(); err != nil {
+		return err
+	}
+
+	e.Collection = self.operator.repository.collection
+	e.Context = self.operator.context
+
+	w := &txWrite{event: e, middlewares: middlewaresFor(e.Collection)}
+
+	var err error
+	w.ran, err = runBefore(w.middlewares, e)
+	if err == ErrSkip {
+		return runAfter(w.middlewares, w.ran, e, nil)
+	}
+
+	var op *txn.Op
+	if err == nil {
+		op, w.after, err = prepare()
+	}
+	if err != nil {
+		return runAfter(w.middlewares, w.ran, e, err)
+	}
+
+	op.C = e.Collection
+	if err := tx.queue(*op, w); err != nil {
+		return runAfter(w.middlewares, w.ran, e, err)
+	}
+	return nil
+}
+
+// splitSelector returns the _id selected by document_selector, and the
+// assertion made of its other fields, txn.DocExists when there's none.
+func splitSelector(document_selector interface{}) (interface{}, interface{}, error) {
+	var selector bson.D
+
+	switch s := document_selector.(type) {
+	case bson.D:
+		selector = s
+	case nil:
+		return nil, nil, ErrTransactionSelector
+	default:
+		data, err := bson.Marshal(document_selector)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := bson.Unmarshal(data, &selector); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var id interface{}
+	assert := bson.D{}
+
+	for _, field := range selector {
+		if field.Name != "_id" {
+			assert = append(assert, field)
+			continue
+		}
+
+		switch field.Value.(type) {
+		case nil, bson.D, bson.M:
+			return nil, nil, ErrTransactionSelector
+		}
+		id = field.Value
+	}
+
+	if id == nil {
+		return nil, nil, ErrTransactionSelector
+	}
+	if len(assert) == 0 {
+		return id, txn.DocExists, nil
+	}
+	return id, assert, nil
+}
+
+// documentId returns the _id of doc, or nil when it has none.
+func documentId(doc interface{}) interface{} {
+	var key struct {
+		Id interface{} `bson:"_id"`
+	}
+	if data, err := bson.Marshal(doc); err == nil && bson.Unmarshal(data, &key) == nil {
+		return key.Id
+	}
+	return nil
+}
+
+// updateDocument returns doc when it's an update document, and otherwise
+// the update replacing the document with doc as mgo/txn takes no
+// replacement documents: a $set of its fields but _id, and an $unset of
+// the fields of its struct type it leaves out, such as the empty fields
+// tagged omitempty. Fields unknown to the type are kept.
+func updateDocument(doc interface{}) (interface{}, error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields bson.D
+	if err := bson.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	if len(fields) > 0 && strings.HasPrefix(fields[0].Name, "$") {
+		return fields, nil
+	}
+
+	set := make(bson.D, 0, len(fields))
+	present := map[string]bool{}
+	for _, field := range fields {
+		present[field.Name] = true
+		if field.Name != "_id" {
+			set = append(set, field)
+		}
+	}
+
+	update := bson.D{}
+	if len(set) > 0 {
+		update = append(update, bson.DocElem{Name: "$set", Value: set})
+	}
+
+	unset := bson.D{}
+	for _, name := range structFieldNames(reflect.TypeOf(doc)) {
+		if !present[name] && name != "_id" {
+			unset = append(unset, bson.DocElem{Name: name, Value: 1})
+		}
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.DocElem{Name: "$unset", Value: unset})
+	}
+
+	return update, nil
+}
+
+// structFieldNames returns the names of the fields of the documents of the
+// struct type typ, none when it's not a struct.
+func structFieldNames(typ reflect.Type) []string {
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+
+		name, inline := bsonFieldName(field)
+		switch {
+		case name == "-":
+		case inline:
+			names = append(names, structFieldNames(field.Type)...)
+		default:
+			names = append(names, name)
+		}
+	}
+	return names
+}